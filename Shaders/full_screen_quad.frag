@@ -2,6 +2,7 @@
 
 uniform sampler2D screenImage;
 uniform sampler2D bloomImage;
+uniform sampler2D glowImage;
 
 uniform ivec2 physical_border_dims = ivec2(64,8);
 uniform ivec2 screen_dims = ivec2(512,512); // of terminal
@@ -12,6 +13,30 @@ uniform float noiseStrength = .03;
 uniform float ambient = .12;
 uniform float text_brightness = .5;
 uniform float bloomStrength = 1.2;
+uniform float persistence = 0;
+uniform int bloomLevels = 3;
+uniform float bellFlash = 0;
+
+uniform vec2 curvature = vec2(0); // per axis, positive bulges like a CRT, negative pinches
+uniform float cornerRadius = .06;
+uniform float overscan = 0;
+
+// Analog signal faults, offsets are in pixels of the terminal image
+uniform float convergence = 0; // red and blue guns miss in opposite directions
+uniform float syncJitter = 0; // most a line is pushed sideways
+uniform float flicker = 0;
+uniform float flickerHz = 60;
+uniform float ghosting = 0; // brightness of the echo
+uniform float ghostOffset = 6;
+uniform float interlace = 0; // how much the field not being drawn has faded
+uniform float seconds = 0;
+uniform int field = 0;
+
+// Phosphor mask, 0 none, 1 shadow mask dot trios, 2 aperture grille, 3 slot mask
+uniform int maskType = 0;
+uniform float maskStrength = .3;
+uniform float maskPitch = 3; // output pixels per trio at the default window size
+uniform vec2 output_scale = vec2(1); // window size over the default window size
 
 in vec2 inUV;
 out vec4 color;
@@ -36,12 +61,94 @@ float sdRoundedBox( in vec2 p, in vec2 b, in vec4 r )
     return min(max(q.x,q.y),0.0) + length(max(q,0.0)) - r.x;
 }
 
+// curve maps a point on the glass to the point of the image shown there,
+// windowToCell in selection.go does the same for the mouse
+vec2 curve(vec2 uv){
+    vec2 c = uv - .5;
+    c *= 1.0 + curvature * dot(c, c);
+    c *= 1.0 - overscan;
+    return c + .5;
+}
+
+// strength keeps a little light through the mask so compensating for it
+// never divides by nothing
+float strength(){
+    return clamp(maskStrength, 0.0, .9);
+}
+
+// mask is how much of each channel the phosphor pattern lets through at
+// an output pixel, between 1-maskStrength and 1
+vec3 mask(vec2 frag){
+    //the pattern grows with the window so it keeps its size on the glass,
+    //but never below a pixel a phosphor or it turns into moire
+    float pitch = max(maskPitch * output_scale.y, 3.0);
+    vec2 p = frag / pitch;
+    float dark = 1.0 - strength();
+
+    if (maskType == 1){
+        //trios of dots, every other row shifted half a trio
+        p.x += .5 * mod(floor(p.y * 2.0), 2.0);
+    } else if (maskType == 3){
+        //slots are two trios wide high, columns of them staggered by half a slot
+        p.y += .5 * mod(floor(p.x), 2.0);
+    }
+
+    vec3 m = vec3(dark);
+    int channel = int(floor(fract(p.x) * 3.0));
+    m[channel] = 1.0;
+
+    if (maskType == 1 && fract(p.y * 2.0) > .75){
+        m = vec3(dark);
+    } else if (maskType == 3 && fract(p.y) > .85){
+        m = vec3(dark);
+    }
+    return m;
+}
+
+// maskMean is the average a mask lets through, dividing by it keeps the
+// brightness of the screen
+float maskMean(){
+    float stripes = 1.0 - strength() * 2.0 / 3.0;
+    if (maskType == 1){
+        return mix(stripes, 1.0 - strength(), .25);
+    } else if (maskType == 3){
+        return mix(stripes, 1.0 - strength(), .15);
+    }
+    return stripes;
+}
+
+// screenAt is the text with its afterglow at a point of the image, the
+// red and blue guns landing either side of green when convergence is off
+vec3 screenAt(vec2 uv){
+    vec2 miss = vec2(convergence / float(screen_dims.x), 0);
+    vec2 g = flipY(uv);
+    vec3 col = vec3(
+        texture(screenImage, flipY(uv + miss)).r,
+        texture(screenImage, g).g,
+        texture(screenImage, flipY(uv - miss)).b);
+    vec3 glow = vec3(
+        texture(glowImage, flipY(uv + miss)).r,
+        texture(glowImage, g).g,
+        texture(glowImage, flipY(uv - miss)).b);
+    //phosphor afterglow of earlier frames
+    return max(col, glow * persistence);
+}
+
 void main(){
 
 
     vec2 UV = inUV;
     UV *=vec2(screen_dims+physical_border_dims*2)/vec2(screen_dims);
     UV -= vec2(physical_border_dims)/vec2(screen_dims);
+    UV = curve(UV);
+
+    //horizontal sync wanders a little differently on every line, a new
+    //wander about every 50ms
+    if (syncJitter != 0){
+        float line = floor((1.0 - UV.y) * float(screen_dims.y));
+        float wander = gold_noise(vec2(line + 1.0, 7.0), 1.0 + floor(seconds * 20.0)) * 2.0 - 1.0;
+        UV.x += wander * syncJitter / float(screen_dims.x);
+    }
 
     ivec2 pix = ivec2(flipY(UV)*screen_dims);
 
@@ -59,9 +166,18 @@ void main(){
     float noiseAddition = gold_noise(vec2(pix), float(12+(ScanlinePosition/(2*512))%30000));
     noiseAddition = float(noiseAddition > .5);
 
-    vec3 termCol = texture(screenImage, flipY(UV)).xyz;
+    vec3 termCol = screenAt(UV);
+    //a reflection in the cable shows a faint copy trailing to the right
+    if (ghosting != 0){
+        termCol += ghosting * screenAt(UV - vec2(ghostOffset / float(screen_dims.x), 0));
+    }
     
-    vec3 bloomCol = texture(bloomImage, flipY(UV)).xyz;
+    //levels of the bloom chain spread the glow further each
+    vec3 bloomCol = vec3(0);
+    for (int i = 0; i < bloomLevels; i++){
+        bloomCol += textureLod(bloomImage, flipY(UV), float(i)).xyz;
+    }
+    bloomCol /= float(max(bloomLevels, 1));
 
     vec3 textCol = vec3(ambient) + termCol * text_brightness;;
     vec3 col = textCol;
@@ -70,11 +186,26 @@ void main(){
     col += scanAddition * scanlineStrength ;
     col += ((noiseAddition) * noiseStrength);
 
+    //Visual bell
+    col += bellFlash * .35;
+
+    //mains hum in the brightness
+    col *= 1.0 - flicker * (.5 + .5 * sin(6.2831853 * flickerHz * seconds));
+
+    //every other line belongs to the field that was drawn last frame
+    if (pix.y % 2 != field){
+        col *= 1.0 - interlace;
+    }
+
+    if (maskType != 0){
+        col *= mask(gl_FragCoord.xy) / maskMean();
+    }
+
     //col += .2 * mix(vec3(0), vec3(1), float((pix.x%2==0) != (pix.y%2==0)));
 
     float dist = sdRoundedBox((UV-.5), vec2(.3)
     , vec4(.2));
-    float fast_dist = sdRoundedBox((UV-.5)*1.04, vec2(.5), vec4(.06));
+    float fast_dist = sdRoundedBox((UV-.5)*1.04, vec2(.5), vec4(cornerRadius));
 
     if (dist>0){
         col -= dist * .5; //* textCol*2;
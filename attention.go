@@ -0,0 +1,139 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+const windowTitle = "Monitor"
+
+// Added to the title while events are waiting to be seen
+const titleMarker = "(!) "
+
+// Output matching any of these while the window is unfocused asks for
+// attention like a bell does
+var attentionPatterns []*regexp.Regexp
+
+// Longest unfinished line kept for the patterns, output without newlines
+// would otherwise grow it forever
+const maxWatchLine = 4096
+
+// Most dots drawn in the border for waiting events
+const maxBadgeDots = 8
+
+// Dots in the border of the image now and the border color behind them
+var badgeDots = 0
+var badgeGap color.RGBA
+
+func focusCall(w *glfw.Window, focused bool) {
+	term_handler.mu.Lock()
+	term_handler.focused = focused
+	if focused {
+		term_handler.attention = 0
+		term_handler.attentionPending = false
+	}
+	term_handler.mu.Unlock()
+	if focused {
+		w.SetTitle(windowTitle)
+	}
+}
+
+// notify records an event for an unfocused window, the main loop raises it
+func (mw *termHandler) notify() {
+	if mw.focused {
+		return
+	}
+	mw.attention++
+	mw.attentionPending = true
+}
+
+// watchOutput checks each finished line of output against the attention
+// patterns. Reads split lines anywhere, so the unfinished end is kept for
+// the next one
+func (mw *termHandler) watchOutput(text string) {
+	if len(attentionPatterns) == 0 {
+		return
+	}
+	lines := strings.Split(mw.watchTail+text, "\n")
+	mw.watchTail = lines[len(lines)-1]
+	if len(mw.watchTail) > maxWatchLine {
+		mw.watchTail = mw.watchTail[len(mw.watchTail)-maxWatchLine:]
+	}
+	if mw.focused {
+		return
+	}
+	for _, line := range lines[:len(lines)-1] {
+		line = strings.TrimRight(Strip(line), "\r")
+		//a carriage return inside the line means it was written over
+		if i := strings.LastIndex(line, "\r"); i >= 0 {
+			line = line[i+1:]
+		}
+		for _, re := range attentionPatterns {
+			if re.MatchString(line) {
+				mw.notify()
+				return
+			}
+		}
+	}
+}
+
+// updateAttention sets the urgency hint and title marker for new events,
+// GLFW has to be called from the main thread
+func updateAttention(w *glfw.Window, th *termHandler) {
+	th.mu.Lock()
+	pending := th.attentionPending && !th.focused
+	th.attentionPending = false
+	th.mu.Unlock()
+	if pending {
+		w.RequestAttention()
+		w.SetTitle(titleMarker + windowTitle)
+	}
+}
+
+// drawAttentionBadge draws a dot in the top border for each waiting event
+// and returns the area changed
+func drawAttentionBadge(img *image.RGBA, th *termHandler) image.Rectangle {
+	th.mu.Lock()
+	count := th.attention
+	gap := th.gapColor()
+	dot := color.RGBA{255, 255, 255, 255}
+	if th.reverseVideo {
+		dot = color.RGBA{0, 0, 0, 255}
+	}
+	th.mu.Unlock()
+	if count > maxBadgeDots {
+		count = maxBadgeDots
+	}
+	if count == badgeDots && gap == badgeGap {
+		return image.Rectangle{}
+	}
+	badgeDots, badgeGap = count, gap
+
+	size := int(term_borders_dims[1]) / 2
+	right := img.Rect.Dx() - int(term_borders_dims[0])
+	top := (int(term_borders_dims[1]) - size) / 2
+	area := image.Rect(right-maxBadgeDots*size*2, top, right, top+size)
+	fillRect(area, img, gap)
+	for i := 0; i < count; i++ {
+		x := right - (i+1)*size*2
+		fillRect(image.Rect(x, top, x+size, top+size), img, dot)
+	}
+	return area
+}
+
+// loadAttentionPatterns reads one regex per line
+func loadAttentionPatterns(path string) error {
+	return readConfigLines(path, func(line string, lineNum int) {
+		re, err := regexp.Compile(line)
+		if err != nil {
+			log.Printf("%s:%d: %s", path, lineNum, err)
+			return
+		}
+		attentionPatterns = append(attentionPatterns, re)
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"time"
+
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/speaker"
+	"github.com/faiface/beep/wav"
+)
+
+//go:embed Resources/bell.wav
+var bellWav []byte
+
+const (
+	bellNone = iota
+	bellAudible
+	bellVisual
+	bellBoth
+)
+
+var bellModeNames = []string{"None", "Audible", "Visual", "Both"}
+var bellMode = bellBoth
+
+// A bell within this long of the previous one is part of the same burst
+// and stays quiet, so a script ringing in a loop is heard once
+var bellMinInterval = 250 * time.Millisecond
+
+// How long the visual bell takes to fade
+var visualBellDuration = 150 * time.Millisecond
+
+// Brightness added to the screen by the visual bell, 0 to 1
+var bellFlash float32
+
+// loadBell decodes the bell sound once and opens the speaker for it
+func loadBell() (*beep.Buffer, error) {
+	streamer, format, err := wav.Decode(bytes.NewReader(bellWav))
+	if err != nil {
+		return nil, err
+	}
+	defer streamer.Close()
+
+	buffer := beep.NewBuffer(format)
+	buffer.Append(streamer)
+	if err := speaker.Init(format.SampleRate, format.SampleRate.N(time.Second/20)); err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// ring handles BEL
+func (mw *termHandler) ring() {
+	now := time.Now()
+	burst := now.Sub(mw.lastBell) < bellMinInterval
+	mw.lastBell = now
+	if burst {
+		return
+	}
+	mw.notify()
+
+	if (bellMode == bellAudible || bellMode == bellBoth) && mw.bellSound != nil {
+		speaker.Play(mw.bellSound.Streamer(0, mw.bellSound.Len()))
+	}
+	if bellMode == bellVisual || bellMode == bellBoth {
+		mw.flashStart = now
+	}
+}
+
+// flashAmount is how bright the visual bell is right now
+func (th *termHandler) flashAmount() float32 {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	left := visualBellDuration - time.Since(th.flashStart)
+	if left <= 0 {
+		return 0
+	}
+	return float32(left) / float32(visualBellDuration)
+}
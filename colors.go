@@ -0,0 +1,193 @@
+package main
+
+import (
+	"image/color"
+	"strings"
+
+	"golang.org/x/image/colornames"
+)
+
+// Colors in TermColor are 0 for the default, 1 to 256 for the palette and
+// rgbFlag with the red, green and blue bytes for direct color
+const (
+	colorDefault = 0
+	rgbFlag      = 1 << 24
+)
+
+func paletteColor(i int) int { return 1 + i&255 }
+
+func rgbColor(r, g, b int) int {
+	return rgbFlag | clampByte(r)<<16 | clampByte(g)<<8 | clampByte(b)
+}
+
+func clampByte(v int) int {
+	if v > 255 {
+		return 255
+	}
+	return v
+}
+
+const (
+	phosphorWheat = iota
+	phosphorP1
+	phosphorP3
+	phosphorP4
+	phosphorFullColor
+)
+
+var phosphorNames = []string{"Wheat", "P1 Green", "P3 Amber", "P4 White", "Full Color"}
+
+// Tint of each monochrome phosphor, colors become shades of it
+var phosphorTints = []color.RGBA{
+	colornames.Wheat,
+	{51, 255, 102, 255},
+	{255, 176, 0, 255},
+	{225, 230, 255, 255},
+}
+
+var phosphor = phosphorWheat
+
+// Text without a color in full color mode
+var defaultForeground = colornames.Wheat
+
+// xterm's 16 colors, the 6x6x6 cube and the gray ramp
+var palette = func() (p [256]color.RGBA) {
+	base := []color.RGBA{
+		{0, 0, 0, 255}, {205, 0, 0, 255}, {0, 205, 0, 255}, {205, 205, 0, 255},
+		{0, 0, 238, 255}, {205, 0, 205, 255}, {0, 205, 205, 255}, {229, 229, 229, 255},
+		{127, 127, 127, 255}, {255, 0, 0, 255}, {0, 255, 0, 255}, {255, 255, 0, 255},
+		{92, 92, 255, 255}, {255, 0, 255, 255}, {0, 255, 255, 255}, {255, 255, 255, 255},
+	}
+	copy(p[:], base)
+	levels := []uint8{0, 95, 135, 175, 215, 255}
+	for i := 0; i < 216; i++ {
+		p[16+i] = color.RGBA{levels[i/36], levels[i/6%6], levels[i%6], 255}
+	}
+	for i := 0; i < 24; i++ {
+		v := uint8(8 + 10*i)
+		p[232+i] = color.RGBA{v, v, v, 255}
+	}
+	return p
+}()
+
+func (tc TermColor) ForegroundRGBA() color.RGBA {
+	if tc.inverse {
+		return tc.rgba(tc.background, false)
+	}
+	return tc.rgba(tc.foreground, true)
+}
+func (tc TermColor) BackgroundRGBA() color.RGBA {
+	if tc.inverse {
+		return tc.rgba(tc.foreground, true)
+	}
+	return tc.rgba(tc.background, false)
+}
+
+// rgba resolves a color through the phosphor in use, fg tells the default
+// foreground from the default background
+func (tc TermColor) rgba(c int, fg bool) color.RGBA {
+	if c == colorDefault && !fg {
+		return colornames.Black
+	}
+	if phosphor != phosphorFullColor && c == colorDefault {
+		return phosphorTints[phosphor]
+	}
+
+	full := defaultForeground
+	switch {
+	case c&rgbFlag != 0:
+		full = color.RGBA{uint8(c >> 16), uint8(c >> 8), uint8(c), 255}
+	case c != colorDefault:
+		i := c - 1
+		if fg && tc.bold && i < 8 {
+			//bold brightens the first eight colors
+			i += 8
+		}
+		full = palette[i]
+	}
+	if phosphor == phosphorFullColor {
+		return full
+	}
+
+	//monochrome, text keeps some brightness so dark colors stay readable
+	//and backgrounds are dimmed so text stands out on them
+	lum := (.299*float64(full.R) + .587*float64(full.G) + .114*float64(full.B)) / 255
+	if fg {
+		lum = .3 + .7*lum
+	} else {
+		lum *= .5
+	}
+	tint := phosphorTints[phosphor]
+	return color.RGBA{uint8(float64(tint.R) * lum), uint8(float64(tint.G) * lum), uint8(float64(tint.B) * lum), 255}
+}
+
+// handleSGR sets the pen new text is written with from Select Graphic
+// Rendition
+func (mw *termHandler) handleSGR(body string) {
+	fields := strings.Split(body, ";")
+	for i := 0; i < len(fields); i++ {
+		if strings.Contains(fields[i], ":") {
+			//38:5:n and 38:2::r:g:b keep their parts together
+			sub := csiParams(strings.ReplaceAll(fields[i], ":", ";"), 0)
+			if len(sub) >= 5 && sub[1] == 2 {
+				n := len(sub)
+				sub = []int{sub[0], 2, sub[n-3], sub[n-2], sub[n-1]}
+			}
+			if c, used := extendedColor(sub[1:]); used > 0 {
+				mw.setPenColor(sub[0], c)
+			}
+			continue
+		}
+		n := csiParams(fields[i], 0)[0]
+		switch {
+		case n == 0:
+			mw.pen = TermColor{}
+		case n == 1:
+			mw.pen.bold = true
+		case n == 22:
+			mw.pen.bold = false
+		case n == 7:
+			mw.pen.inverse = true
+		case n == 27:
+			mw.pen.inverse = false
+		case n >= 30 && n <= 37:
+			mw.pen.foreground = paletteColor(n - 30)
+		case n >= 90 && n <= 97:
+			mw.pen.foreground = paletteColor(n - 90 + 8)
+		case n == 39:
+			mw.pen.foreground = colorDefault
+		case n >= 40 && n <= 47:
+			mw.pen.background = paletteColor(n - 40)
+		case n >= 100 && n <= 107:
+			mw.pen.background = paletteColor(n - 100 + 8)
+		case n == 49:
+			mw.pen.background = colorDefault
+		case n == 38 || n == 48:
+			c, used := extendedColor(csiParams(strings.Join(fields[i+1:], ";"), 0))
+			if used > 0 {
+				mw.setPenColor(n, c)
+			}
+			i += used
+		}
+	}
+}
+
+func (mw *termHandler) setPenColor(which, c int) {
+	if which == 38 {
+		mw.pen.foreground = c
+	} else if which == 48 {
+		mw.pen.background = c
+	}
+}
+
+// extendedColor reads the 5;n or 2;r;g;b following a 38 or 48, used is the
+// number of parameters taken
+func extendedColor(p []int) (c int, used int) {
+	if len(p) >= 2 && p[0] == 5 {
+		return paletteColor(p[1]), 2
+	}
+	if len(p) >= 4 && p[0] == 2 {
+		return rgbColor(p[1], p[2], p[3]), 4
+	}
+	return colorDefault, 0
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestHandleSGR(t *testing.T) {
+	red := paletteColor(1)
+	tests := []struct {
+		body string
+		want TermColor
+	}{
+		{"31", TermColor{foreground: red}},
+		{"91", TermColor{foreground: paletteColor(9)}},
+		{"41", TermColor{background: red}},
+		{"101", TermColor{background: paletteColor(9)}},
+		{"1;7", TermColor{bold: true, inverse: true}},
+		{"1;7;22;27", TermColor{}},
+		{"31;41;39;49", TermColor{}},
+		{"1;31;0", TermColor{}},
+		{"1;31;", TermColor{}},
+		{"38;5;196", TermColor{foreground: paletteColor(196)}},
+		{"48;5;4;1", TermColor{background: paletteColor(4), bold: true}},
+		{"38;2;1;2;3", TermColor{foreground: rgbColor(1, 2, 3)}},
+		{"38;2;300;-1;9", TermColor{foreground: rgbColor(255, 0, 9)}},
+		{"38:2::1:2:3", TermColor{foreground: rgbColor(1, 2, 3)}},
+		{"38:2:1:2:3", TermColor{foreground: rgbColor(1, 2, 3)}},
+		{"48:5:4;1", TermColor{background: paletteColor(4), bold: true}},
+		{"38;5", TermColor{}},
+		{"38:5", TermColor{}},
+	}
+	for _, tt := range tests {
+		th := testTerminal()
+		th.handleSGR(tt.body)
+		if th.pen != tt.want {
+			t.Errorf("handleSGR(%q) set %+v, want %+v", tt.body, th.pen, tt.want)
+		}
+	}
+}
+
+func TestExtendedColor(t *testing.T) {
+	tests := []struct {
+		p    []int
+		c    int
+		used int
+	}{
+		{[]int{5, 196}, paletteColor(196), 2},
+		{[]int{5, 260, 1}, paletteColor(4), 2},
+		{[]int{2, 1, 2, 3}, rgbColor(1, 2, 3), 4},
+		{[]int{2, 1, 2, 3, 1}, rgbColor(1, 2, 3), 4},
+		{[]int{2, 1, 2}, colorDefault, 0},
+		{[]int{5}, colorDefault, 0},
+		{[]int{3, 1}, colorDefault, 0},
+		{nil, colorDefault, 0},
+	}
+	for _, tt := range tests {
+		if c, used := extendedColor(tt.p); c != tt.c || used != tt.used {
+			t.Errorf("extendedColor(%v) = %#x, %d, want %#x, %d", tt.p, c, used, tt.c, tt.used)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configPath is where a config file lives, $XDG_CONFIG_HOME/monitor or
+// ~/.config/monitor. os.UserConfigDir isn't used as it points elsewhere
+// on macOS
+func configPath(name string) string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "monitor", name)
+}
+
+// readConfigLines calls each with every line of a config file, trimmed and
+// numbered from 1 for messages. Blank lines and # comments are skipped
+func readConfigLines(path string, each func(line string, lineNum int)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		each(line, lineNum)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/font/opentype"
+)
+
+//go:embed Fonts
+var bundledFonts embed.FS
+
+// A font offered in the settings, size is in pixels
+type fontChoice struct {
+	name string
+	path string //in the embedded Fonts directory unless absolute, empty for the built in 7x13
+	size float32
+}
+
+var fonts = []fontChoice{
+	{"Basic 7x13", "", 13},
+	{"Kongtext", "Fonts/kongtext.ttf", 8},
+	{"Commodore PET", "Fonts/CommodorePET.TTF", 8},
+	{"IBM VGA9", "Fonts/PxPlus_IBM_VGA9.ttf", 16},
+}
+
+var fontIndex = 0
+var fontSize float32 = 13
+
+// Font sizes the settings allow, smaller isn't readable and larger leaves
+// hardly any cells
+const (
+	minFontSize = 4
+	maxFontSize = 64
+)
+
+// Distance from the top of a cell to the baseline of its text
+var char_baseline int32 = 11
+
+// The font and size the images were last made for
+var loadedFont = -1
+var loadedSize float32
+
+// Parsed font files by path
+var parsedFonts = map[string]*opentype.Font{}
+
+// fontSetting cycles through the fonts, each starting at its own size
+type fontSetting struct{}
+
+func (fontSetting) label() string { return fmt.Sprintf("Font: <%s>", fonts[fontIndex].name) }
+func (fontSetting) increment()    { selectFont((fontIndex + 1) % len(fonts)) }
+func (fontSetting) decrement()    { selectFont((fontIndex + len(fonts) - 1) % len(fonts)) }
+
+func selectFont(i int) {
+	fontIndex = i
+	fontSize = fonts[i].size
+}
+
+// addFont selects a bundled font by name or file name, or adds the font
+// file at path
+func addFont(path string, size float32) {
+	for i, f := range fonts {
+		if strings.EqualFold(f.name, path) || (f.path != "" && strings.EqualFold(filepath.Base(f.path), path)) {
+			selectFont(i)
+			if size > 0 {
+				fontSize = size
+			}
+			return
+		}
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	if size <= 0 {
+		size = 16
+	}
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	fonts = append(fonts, fontChoice{name, abs, size})
+	selectFont(len(fonts) - 1)
+}
+
+// fontChanged is true when the settings ask for a different font than the one in use
+func fontChanged() bool {
+	//the size can come from a flag or config beyond the setting's range
+	if fontSize < minFontSize {
+		fontSize = minFontSize
+	} else if fontSize > maxFontSize {
+		fontSize = maxFontSize
+	}
+	return fontIndex != loadedFont || fontSize != loadedSize
+}
+
+// loadFace opens a font at a pixel size
+func loadFace(choice fontChoice, size float32) (font.Face, error) {
+	if choice.path == "" {
+		return basicfont.Face7x13, nil
+	}
+	f, ok := parsedFonts[choice.path]
+	if !ok {
+		var data []byte
+		var err error
+		if filepath.IsAbs(choice.path) {
+			data, err = os.ReadFile(choice.path)
+		} else {
+			data, err = bundledFonts.ReadFile(choice.path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		f, err = opentype.Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", choice.path, err)
+		}
+		parsedFonts[choice.path] = f
+	}
+	return opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    float64(size),
+		DPI:     72, //so the size is in pixels
+		Hinting: font.HintingFull,
+	})
+}
+
+// applyFont switches to the selected font and sizes the cells from its
+// metrics, the images and textures have to be made again afterwards
+func applyFont() error {
+	loadedFont, loadedSize = fontIndex, fontSize
+	face, err := loadFace(fonts[fontIndex], fontSize)
+	if err != nil {
+		return err
+	}
+	metrics := face.Metrics()
+	advance, _ := face.GlyphAdvance('M')
+	height := metrics.Height
+	if metrics.Ascent+metrics.Descent > height {
+		height = metrics.Ascent + metrics.Descent
+	}
+
+	myFontFace = face
+	char_dims = [2]int32{int32(advance.Ceil()), int32(height.Ceil())}
+	char_baseline = int32(metrics.Ascent.Ceil())
+	terminal_dims = [2]int32{term_cells[0] * char_dims[0], term_cells[1] * char_dims[1]}
+	default_win_dims = [2]int32{(terminal_dims[0] + term_borders_dims[0]) * 2, (terminal_dims[1] + term_borders_dims[1]) * 2}
+
+	if th := term_handler; th != nil {
+		th.mu.Lock()
+		th.charWidth, th.charHeight = int(char_dims[0]), int(char_dims[1])
+		th.touchAll()
+		th.mu.Unlock()
+	}
+	return nil
+}
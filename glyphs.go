@@ -0,0 +1,139 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// Glyphs per row of the atlas
+const atlasColumns = 64
+
+// Tallest the atlas grows, well inside GL_MAX_TEXTURE_SIZE of any GL 4.6
+// driver. Output with more distinct glyphs than fit shows the fallback
+const atlasMaxHeight = 4096
+
+// Glyph 0 of every atlas, drawn for glyphs that no longer fit
+const fallbackGlyph = "\uFFFD"
+
+// glyphKey is what a glyph is rasterised for, style leaves room for bold
+// and italic faces
+type glyphKey struct {
+	char  string
+	style int
+}
+
+// glyphAtlas holds each glyph of a face rasterised once as an alpha mask,
+// laid out in cells the size of a character
+type glyphAtlas struct {
+	face                   font.Face
+	cellW, cellH, baseline int
+	img                    *image.Alpha
+	index                  map[glyphKey]int
+	count                  int //glyphs rasterised, the next goes in slot count
+}
+
+var atlas *glyphAtlas
+
+func newGlyphAtlas(face font.Face) *glyphAtlas {
+	a := &glyphAtlas{
+		face:     face,
+		cellW:    int(char_dims[0]),
+		cellH:    int(char_dims[1]),
+		baseline: int(char_baseline),
+		img:      image.NewAlpha(image.Rect(0, 0, atlasColumns*int(char_dims[0]), int(char_dims[1]))),
+		index:    map[glyphKey]int{},
+	}
+	a.add(glyphKey{fallbackGlyph, 0})
+	return a
+}
+
+// glyphIndex is where a glyph of the current font sits in the atlas,
+// rasterising it the first time it is asked for
+func glyphIndex(key glyphKey) int {
+	a := currentAtlas()
+	if i, ok := a.index[key]; ok {
+		return i
+	}
+	if (a.count/atlasColumns+1)*a.cellH > atlasMaxHeight {
+		//full, remembered so the check isn't repeated
+		a.index[key] = 0
+		return 0
+	}
+	return a.add(key)
+}
+
+// add rasterises a glyph into the next free slot
+func (a *glyphAtlas) add(key glyphKey) int {
+	i := a.count
+	a.count++
+	a.index[key] = i
+	if rows := i/atlasColumns + 1; rows*a.cellH > a.img.Rect.Dy() {
+		//double the rows, the stride stays the same so the pixels copy over
+		height := 2 * a.img.Rect.Dy()
+		if height > atlasMaxHeight {
+			height = atlasMaxHeight
+		}
+		grown := image.NewAlpha(image.Rect(0, 0, a.img.Rect.Dx(), height))
+		copy(grown.Pix, a.img.Pix)
+		a.img = grown
+	}
+	cell := a.cellRect(i)
+	d := &font.Drawer{
+		Dst:  a.img.SubImage(cell).(draw.Image), //clipped so wide glyphs don't bleed into the next
+		Src:  image.Opaque,
+		Face: a.face,
+		Dot:  fixed.P(cell.Min.X, cell.Min.Y+a.baseline),
+	}
+	d.DrawString(key.char)
+	return i
+}
+
+// currentAtlas is the atlas for the font in use, starting a new one when
+// the font changes
+func currentAtlas() *glyphAtlas {
+	if atlas == nil || atlas.face != myFontFace || atlas.cellW != int(char_dims[0]) || atlas.cellH != int(char_dims[1]) {
+		atlas = newGlyphAtlas(myFontFace)
+	}
+	return atlas
+}
+
+// glyphMask is the alpha mask of a glyph in the current font
+func glyphMask(key glyphKey) *image.Alpha {
+	i := glyphIndex(key)
+	return atlas.img.SubImage(atlas.cellRect(i)).(*image.Alpha)
+}
+
+func (a *glyphAtlas) cellRect(i int) image.Rectangle {
+	x, y := (i%atlasColumns)*a.cellW, (i/atlasColumns)*a.cellH
+	return image.Rect(x, y, x+a.cellW, y+a.cellH)
+}
+
+// drawGlyph blends a cached glyph onto img with its top left corner at x,y
+func drawGlyph(img *image.RGBA, x, y int, char string, col color.RGBA) {
+	mask := glyphMask(glyphKey{char, 0})
+	dst := image.Rect(x, y, x+mask.Rect.Dx(), y+mask.Rect.Dy()).Intersect(img.Rect)
+	for py := dst.Min.Y; py < dst.Max.Y; py++ {
+		mrow := mask.Pix[mask.PixOffset(mask.Rect.Min.X+dst.Min.X-x, mask.Rect.Min.Y+py-y):]
+		drow := img.Pix[img.PixOffset(dst.Min.X, py):]
+		for px := 0; px < dst.Dx(); px++ {
+			a := uint32(mrow[px])
+			if a == 0 {
+				continue
+			}
+			p := drow[px*4 : px*4+4]
+			p[0] = uint8((uint32(p[0])*(255-a) + uint32(col.R)*a) / 255)
+			p[1] = uint8((uint32(p[1])*(255-a) + uint32(col.G)*a) / 255)
+			p[2] = uint8((uint32(p[2])*(255-a) + uint32(col.B)*a) / 255)
+			p[3] = 255
+		}
+	}
+}
+
+// packColor puts a color in a uint32 the way GLSL unpackUnorm4x8 reads it
+func packColor(c color.RGBA) uint32 {
+	return uint32(c.R) | uint32(c.G)<<8 | uint32(c.B)<<16 | uint32(c.A)<<24
+}
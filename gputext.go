@@ -0,0 +1,101 @@
+package main
+
+import (
+	_ "embed"
+
+	"github.com/go-gl/gl/v4.6-core/gl"
+)
+
+//go:embed Shaders/text.comp
+var textCompSrc string
+
+// Draw the text layer on the GPU from the cell grid instead of on the CPU
+var gpuText = false
+
+// textPass builds the text texture on the GPU. The cells go up as an
+// RGBA32UI texture, one texel a cell, and the glyph atlas as R8 at the
+// most the atlas can grow to, so new glyphs only send their rows
+type textPass struct {
+	program  uint32
+	cellTex  uint32
+	atlasTex uint32
+	cells    []uint32
+
+	//the atlas and how many of its glyphs are on the GPU
+	atlas    *glyphAtlas
+	uploaded int
+}
+
+func newTextPass(cols, rows int) *textPass {
+	program, err := BuildCompute(textCompSrc)
+	check(err)
+	p := &textPass{program: program, cells: make([]uint32, cols*rows*4)}
+
+	gl.GenTextures(1, &p.cellTex)
+	gl.BindTexture(gl.TEXTURE_2D, p.cellTex)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA32UI, int32(cols), int32(rows), 0, gl.RGBA_INTEGER, gl.UNSIGNED_INT, gl.Ptr(p.cells))
+
+	gl.GenTextures(1, &p.atlasTex)
+	gl.BindTexture(gl.TEXTURE_2D, p.atlasTex)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	return p
+}
+
+// draw brings the cell and atlas textures up to date and, when anything
+// changed, rebuilds the text layer in target
+func (p *textPass) draw(th *termHandler, target uint32) {
+	first, last, gap, border := th.DrawToCells(p.cells)
+	a := currentAtlas()
+	if first < 0 && !border && a == p.atlas && a.count == p.uploaded {
+		return
+	}
+	cols := int32(len(p.cells) / 4 / len(th.buffer))
+
+	gl.ActiveTexture(gl.TEXTURE0)
+	if first >= 0 {
+		gl.BindTexture(gl.TEXTURE_2D, p.cellTex)
+		gl.TexSubImage2D(gl.TEXTURE_2D, 0, 0, int32(first), cols, int32(last-first+1),
+			gl.RGBA_INTEGER, gl.UNSIGNED_INT, gl.Ptr(p.cells[first*int(cols)*4:]))
+	}
+	if a != p.atlas || a.count != p.uploaded {
+		gl.BindTexture(gl.TEXTURE_2D, p.atlasTex)
+		if a != p.atlas {
+			//a new font, the texture is sized for the most the atlas holds
+			gl.TexImage2D(gl.TEXTURE_2D, 0, gl.R8, int32(a.img.Rect.Dx()), atlasMaxHeight, 0, gl.RED, gl.UNSIGNED_BYTE, nil)
+			p.atlas, p.uploaded = a, 0
+		}
+		//the rows holding glyphs added since the last upload
+		top := p.uploaded / atlasColumns * a.cellH
+		bottom := ((a.count-1)/atlasColumns + 1) * a.cellH
+		gl.PixelStorei(gl.UNPACK_ALIGNMENT, 1)
+		gl.TexSubImage2D(gl.TEXTURE_2D, 0, 0, int32(top), int32(a.img.Rect.Dx()), int32(bottom-top),
+			gl.RED, gl.UNSIGNED_BYTE, gl.Ptr(a.img.Pix[a.img.PixOffset(0, top):]))
+		gl.PixelStorei(gl.UNPACK_ALIGNMENT, 4)
+		p.uploaded = a.count
+	}
+
+	gl.UseProgram(p.program)
+	gl.BindImageTexture(0, p.cellTex, 0, false, 0, gl.READ_ONLY, gl.RGBA32UI)
+	gl.BindImageTexture(1, p.atlasTex, 0, false, 0, gl.READ_ONLY, gl.R8)
+	gl.BindImageTexture(2, target, 0, false, 0, gl.WRITE_ONLY, gl.RGBA8)
+	gl.Uniform2i(gl.GetUniformLocation(p.program, gl.Str("char_dims\x00")), char_dims[0], char_dims[1])
+	gl.Uniform2i(gl.GetUniformLocation(p.program, gl.Str("border\x00")), term_borders_dims[0], term_borders_dims[1])
+	gl.Uniform1i(gl.GetUniformLocation(p.program, gl.Str("atlas_columns\x00")), atlasColumns)
+	gl.Uniform4f(gl.GetUniformLocation(p.program, gl.Str("gap\x00")),
+		float32(gap.R)/255, float32(gap.G)/255, float32(gap.B)/255, 1)
+	gl.Uniform1i(gl.GetUniformLocation(p.program, gl.Str("fill_border\x00")), boolToInt(border))
+
+	var groupSize uint32 = 16
+	size := [2]uint32{uint32(terminal_dims[0]), uint32(terminal_dims[1])}
+	if border {
+		//the whole image, the border goes over to gap as well
+		size[0] += 2 * uint32(term_borders_dims[0])
+		size[1] += 2 * uint32(term_borders_dims[1])
+	}
+	gl.DispatchCompute((size[0]+groupSize)/groupSize, (size[1]+groupSize)/groupSize, 1)
+	//bloom reads the result as an image, overlays are uploaded over it
+	gl.MemoryBarrier(gl.SHADER_IMAGE_ACCESS_BARRIER_BIT | gl.TEXTURE_UPDATE_BARRIER_BIT | gl.TEXTURE_FETCH_BARRIER_BIT)
+}
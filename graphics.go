@@ -4,6 +4,7 @@ import (
 	_ "embed"
 	"image"
 	"image/color"
+	"math"
 
 	"github.com/go-gl/gl/v4.6-core/gl"
 	"github.com/go-gl/glfw/v3.3/glfw"
@@ -18,24 +19,95 @@ var vertSrc string
 //go:embed Shaders/blur_shader.comp
 var compSrc string
 
-func doCompute(program uint32, from, to uint32, size [2]int32) {
-	sz := [2]uint32{uint32(size[0]), uint32(size[1])}
+//go:embed Shaders/persistence.comp
+var persistenceSrc string
+
+// doPersistence fades the glow earlier frames left in glow by dt seconds
+// worth of decay and adds the text of this frame
+func doPersistence(program uint32, text, glow uint32, dt float32) {
+	gl.UseProgram(program)
+	gl.BindImageTexture(0, text, 0, false, 0, gl.READ_ONLY, gl.RGBA8)
+	gl.BindImageTexture(1, glow, 0, false, 0, gl.READ_WRITE, gl.RGBA16F)
+	//the decay settings are per frame at 60fps
+	frames := float64(dt * 60)
+	kept := func(decay float32) float32 {
+		return float32(math.Pow(math.Max(0, math.Min(1, float64(decay))), frames))
+	}
+	gl.Uniform3f(gl.GetUniformLocation(program, gl.Str("decay\x00")), kept(decayRed), kept(decayGreen), kept(decayBlue))
+
+	size := [2]uint32{uint32(terminal_dims[0] + 2*term_borders_dims[0]), uint32(terminal_dims[1] + 2*term_borders_dims[1])}
 	var groupSize uint32 = 16
+	gl.DispatchCompute((size[0]+groupSize-1)/groupSize, (size[1]+groupSize-1)/groupSize, 1)
+
+	gl.MemoryBarrier(gl.SHADER_IMAGE_ACCESS_BARRIER_BIT | gl.TEXTURE_FETCH_BARRIER_BIT)
+}
+
+// Most levels the bloom chain can have, each half the size of the last
+const maxBloomLevels = 6
+
+// doBloom blurs the text into the levels of the bloom texture, the first
+// level is half the size of the text. Each level is a horizontal pass from
+// the level above into ping then a vertical one from ping into pong
+func doBloom(program uint32, text, ping, pong uint32) {
 	gl.UseProgram(program)
-	gl.BindImageTexture(0, from, 0, false, 0, gl.READ_ONLY, gl.RGBA8)
-	gl.BindImageTexture(1, to, 0, false, 0, gl.WRITE_ONLY, gl.RGBA8)
-	gl.Uniform1f(gl.GetUniformLocation(program, gl.Str("text_brightness\x00")), bloomBrightness)
+	gl.Uniform1i(gl.GetUniformLocation(program, gl.Str("u_input\x00")), 0)
+	gl.Uniform1i(gl.GetUniformLocation(program, gl.Str("radius\x00")), int32(bloomRadius))
+	gl.Uniform1f(gl.GetUniformLocation(program, gl.Str("sigma\x00")), bloomSigma)
+
+	for level := 0; level < bloomLevels; level++ {
+		from, fromLevel := pong, level-1
+		if level == 0 {
+			from, fromLevel = text, 0
+		}
+		gain := float32(1)
+		if level == 0 {
+			gain = bloomBrightness
+		}
+		blurPass(program, from, fromLevel, ping, level, [2]int32{1, 0}, true, gain)
+		blurPass(program, ping, level, pong, level, [2]int32{0, 1}, false, 1)
+	}
+}
+
+func blurPass(program uint32, from uint32, fromLevel int, to uint32, toLevel int, direction [2]int32, downsample bool, gain float32) {
+	gl.ActiveTexture(gl.TEXTURE0)
+	gl.BindTexture(gl.TEXTURE_2D, from)
+	gl.BindImageTexture(0, to, int32(toLevel), false, 0, gl.WRITE_ONLY, gl.RGBA16F)
+	gl.Uniform1i(gl.GetUniformLocation(program, gl.Str("input_level\x00")), int32(fromLevel))
+	gl.Uniform2i(gl.GetUniformLocation(program, gl.Str("direction\x00")), direction[0], direction[1])
+	gl.Uniform1i(gl.GetUniformLocation(program, gl.Str("downsample\x00")), boolToInt(downsample))
+	gl.Uniform1f(gl.GetUniformLocation(program, gl.Str("gain\x00")), gain)
+
+	size := bloomLevelSize(toLevel)
+	var groupSize uint32 = 16
+	gl.DispatchCompute((uint32(size[0])+groupSize-1)/groupSize, (uint32(size[1])+groupSize-1)/groupSize, 1)
 
-	gl.DispatchCompute((sz[0]+groupSize)/groupSize, (sz[1]+groupSize)/groupSize, 1)
+	gl.MemoryBarrier(gl.SHADER_IMAGE_ACCESS_BARRIER_BIT | gl.TEXTURE_FETCH_BARRIER_BIT)
+}
 
-	gl.MemoryBarrier(gl.SHADER_IMAGE_ACCESS_BARRIER_BIT)
+// bloomLevelSize is the size of a level of the bloom textures, the first
+// is half the text image
+func bloomLevelSize(level int) [2]int32 {
+	size := [2]int32{(terminal_dims[0] + 2*term_borders_dims[0]) / 2, (terminal_dims[1] + 2*term_borders_dims[1]) / 2}
+	for i := range size {
+		size[i] >>= level
+		if size[i] < 1 {
+			size[i] = 1
+		}
+	}
+	return size
+}
 
+func boolToInt(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
 }
 func sizeCallback(win *glfw.Window, w, h int) {
 	win_dims[0] = int32(w)
 	win_dims[1] = int32(h)
 }
-func doDrawing(screenProg uint32, vao uint32, scanline_pos int32, texture, bloom_handle uint32) {
+func doDrawing(screenProg uint32, vao uint32, scanline_pos int32, texture, bloom_handle, glow_handle uint32) {
 	gl.BindVertexArray(vao)
 	gl.UseProgram(screenProg)
 
@@ -45,17 +117,41 @@ func doDrawing(screenProg uint32, vao uint32, scanline_pos int32, texture, bloom
 
 	gl.Uniform1i(gl.GetUniformLocation(screenProg, gl.Str("screenImage\x00")), 0)
 	gl.Uniform1i(gl.GetUniformLocation(screenProg, gl.Str("bloomImage\x00")), 1)
+	gl.Uniform1i(gl.GetUniformLocation(screenProg, gl.Str("glowImage\x00")), 2)
+	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("persistence\x00")), persistence)
 
 	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("scanlineStrength\x00")), scanline_strength)
 	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("bloomStrength\x00")), bloomStrength)
 	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("text_brightness\x00")), text_brightness)
 	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("ambient\x00")), ambient)
 	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("noiseStrength\x00")), noiseStrength)
+	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("bellFlash\x00")), bellFlash)
+	gl.Uniform1i(gl.GetUniformLocation(screenProg, gl.Str("bloomLevels\x00")), int32(bloomLevels))
+	gl.Uniform2f(gl.GetUniformLocation(screenProg, gl.Str("curvature\x00")), curvatureX, curvatureY)
+	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("cornerRadius\x00")), cornerRadius)
+	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("overscan\x00")), overscan)
+	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("convergence\x00")), convergence)
+	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("syncJitter\x00")), syncJitter)
+	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("flicker\x00")), flicker)
+	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("flickerHz\x00")), flickerHz[flickerRate])
+	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("ghosting\x00")), ghosting)
+	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("ghostOffset\x00")), ghostOffset)
+	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("interlace\x00")), interlace)
+	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("seconds\x00")), signalSeconds)
+	gl.Uniform1i(gl.GetUniformLocation(screenProg, gl.Str("field\x00")), int32(signalField))
+	gl.Uniform1i(gl.GetUniformLocation(screenProg, gl.Str("maskType\x00")), int32(maskType))
+	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("maskStrength\x00")), maskStrength)
+	gl.Uniform1f(gl.GetUniformLocation(screenProg, gl.Str("maskPitch\x00")), maskPitch)
+	gl.Uniform2f(gl.GetUniformLocation(screenProg, gl.Str("output_scale\x00")),
+		float32(win_dims[0])/float32(default_win_dims[0]), float32(win_dims[1])/float32(default_win_dims[1]))
 
 	gl.ActiveTexture(gl.TEXTURE0)
 	gl.BindTexture(gl.TEXTURE_2D, texture)
 	gl.ActiveTexture(gl.TEXTURE1)
 	gl.BindTexture(gl.TEXTURE_2D, bloom_handle)
+	gl.ActiveTexture(gl.TEXTURE2)
+	gl.BindTexture(gl.TEXTURE_2D, glow_handle)
+	gl.ActiveTexture(gl.TEXTURE0)
 
 	gl.DrawArrays(gl.TRIANGLES, 0, 6)
 }
@@ -77,33 +173,78 @@ func texFromImage(img *image.RGBA) uint32 {
 	return textureHandle
 }
 
-func overwriteTexWithImage(img *image.RGBA, textureHandle uint32) {
-	var TEXTURE_WIDTH, TEXTURE_HEIGHT int32 = int32(img.Rect.Dx()), int32(img.Rect.Dy())
-
+// overwriteTexWithImage uploads the part of img inside rect, the texture
+// keeps the parameters it was made with
+func overwriteTexWithImage(img *image.RGBA, textureHandle uint32, rect image.Rectangle) {
+	rect = rect.Intersect(img.Rect)
+	if rect.Empty() {
+		return
+	}
 	gl.ActiveTexture(gl.TEXTURE0)
 	gl.BindTexture(gl.TEXTURE_2D, textureHandle)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
-	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
-	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA8, TEXTURE_WIDTH, TEXTURE_HEIGHT, 0, gl.RGBA,
-		gl.UNSIGNED_BYTE, gl.Ptr(img.Pix))
-
+	//rows of the rectangle are a whole image row apart
+	gl.PixelStorei(gl.UNPACK_ROW_LENGTH, int32(img.Stride/4))
+	gl.TexSubImage2D(gl.TEXTURE_2D, 0, int32(rect.Min.X), int32(rect.Min.Y), int32(rect.Dx()), int32(rect.Dy()),
+		gl.RGBA, gl.UNSIGNED_BYTE, gl.Ptr(img.Pix[img.PixOffset(rect.Min.X, rect.Min.Y):]))
+	gl.PixelStorei(gl.UNPACK_ROW_LENGTH, 0)
 }
 
-func makeGLStuff() (uint32, uint32, uint32, *image.RGBA, uint32, uint32, uint32) {
+func makeGLStuff() (uint32, uint32, uint32, *image.RGBA, uint32, uint32, uint32, uint32) {
 	_, vao := screenVBOVAO()
 	screenProg, err := BuildProgram(fragSrc, vertSrc)
 	check(err)
 	blur_program, err := BuildCompute(compSrc)
 	check(err)
 
+	operating_img, textHandle, pingHandle, pongHandle, glowHandle := makeImages()
+
+	return vao, screenProg, blur_program, operating_img, textHandle, pingHandle, pongHandle, glowHandle
+}
+
+// makeImages makes the image the terminal is drawn into and the textures
+// for it, the bloom and the phosphor glow, sized for the current font
+func makeImages() (*image.RGBA, uint32, uint32, uint32, uint32) {
 	operating_img := image.NewRGBA(image.Rect(0, 0, int(terminal_dims[0])+2*int(term_borders_dims[0]), int(terminal_dims[1])+2*int(term_borders_dims[1])))
 	clearImage(operating_img, color.RGBA{0, 0, 0, 255})
 
 	textHandle := texFromImage(operating_img)
-	pingHandle := texFromImage(operating_img)
-	pongHandle := texFromImage(operating_img)
+	pingHandle := bloomTexture(bloomLevelSize(0))
+	pongHandle := bloomTexture(bloomLevelSize(0))
+	glowHandle := glowTexture(operating_img.Rect.Dx(), operating_img.Rect.Dy())
+	return operating_img, textHandle, pingHandle, pongHandle, glowHandle
+}
+
+// glowTexture makes the half float texture phosphor persistence builds up in
+func glowTexture(width, height int) uint32 {
+	var textureHandle uint32
+	gl.GenTextures(1, &textureHandle)
+	gl.ActiveTexture(gl.TEXTURE0)
+	gl.BindTexture(gl.TEXTURE_2D, textureHandle)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	gl.TexStorage2D(gl.TEXTURE_2D, 1, gl.RGBA16F, int32(width), int32(height))
+	//storage starts undefined, the glow starts dark
+	gl.ClearTexImage(textureHandle, 0, gl.RGBA, gl.FLOAT, nil)
+	return textureHandle
+}
+
+// bloomTexture makes a half float texture with room for every bloom level
+func bloomTexture(size [2]int32) uint32 {
+	var textureHandle uint32
+	gl.GenTextures(1, &textureHandle)
+	gl.ActiveTexture(gl.TEXTURE0)
+	gl.BindTexture(gl.TEXTURE_2D, textureHandle)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.LINEAR_MIPMAP_NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAX_LEVEL, maxBloomLevels-1)
+	gl.TexStorage2D(gl.TEXTURE_2D, maxBloomLevels, gl.RGBA16F, size[0], size[1])
+	return textureHandle
+}
 
-	return vao, screenProg, blur_program, operating_img, textHandle, pingHandle, pongHandle
+func deleteTextures(handles ...uint32) {
+	gl.DeleteTextures(int32(len(handles)), &handles[0])
 }
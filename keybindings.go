@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// A keybinding either runs a named action or sends text to the pty
+type keyAction struct {
+	action string
+	send   string
+}
+
+// Named actions, the bool is whether the action repeats while the key is held
+var actions = map[string]struct {
+	run    func(w *glfw.Window)
+	repeat bool
+}{
+	"settings":         {toggleSettings, false},
+	"fullscreen":       {toggleFullscreen, false},
+	"copy":             {copyToClipboard, false},
+	"paste":            {pasteFromClipboard, false},
+	"search":           {toggleSearch, false},
+	"scroll_line_up":   {func(w *glfw.Window) { term_handler.Scroll(1) }, true},
+	"scroll_line_down": {func(w *glfw.Window) { term_handler.Scroll(-1) }, true},
+	"scroll_page_up":   {func(w *glfw.Window) { term_handler.ScrollPage(1) }, true},
+	"scroll_page_down": {func(w *glfw.Window) { term_handler.ScrollPage(-1) }, true},
+	"scroll_top":       {func(w *glfw.Window) { term_handler.ScrollToTop() }, false},
+	"scroll_bottom":    {func(w *glfw.Window) { term_handler.ScrollToBottom() }, false},
+	"zoom_in":          {func(w *glfw.Window) { zoomWindow(w, 1.1) }, true},
+	"zoom_out":         {func(w *glfw.Window) { zoomWindow(w, 1/1.1) }, true},
+	"zoom_reset":       {func(w *glfw.Window) { zoomWindow(w, 0) }, false},
+	"quit":             {func(w *glfw.Window) { os.Exit(0) }, false},
+}
+
+// passthrough sends the key to the program as if it were not bound
+const passthrough = "passthrough"
+
+// Defaults use Ctrl+Shift so that Ctrl+S (XOFF) and Ctrl+Q (XON) reach the
+// shell. Shift+Home/End and Ctrl+Shift+arrows are left to programs, editors
+// select text with them
+var keybindings = map[keyCombo]keyAction{
+	{glfw.KeyS, glfw.ModControl | glfw.ModShift}: {action: "settings"},
+	{glfw.KeyQ, glfw.ModControl | glfw.ModShift}: {action: "quit"},
+	{glfw.KeyF11, 0}: {action: "fullscreen"},
+	{glfw.KeyC, glfw.ModControl | glfw.ModShift}:     {action: "copy"},
+	{glfw.KeyV, glfw.ModControl | glfw.ModShift}:     {action: "paste"},
+	{glfw.KeyInsert, glfw.ModShift}:                  {action: "paste"},
+	{glfw.KeyF, glfw.ModControl | glfw.ModShift}:     {action: "search"},
+	{glfw.KeyPageUp, glfw.ModShift}:                  {action: "scroll_page_up"},
+	{glfw.KeyPageDown, glfw.ModShift}:                {action: "scroll_page_down"},
+	{glfw.KeyEqual, glfw.ModControl | glfw.ModShift}: {action: "zoom_in"},
+	{glfw.KeyMinus, glfw.ModControl | glfw.ModShift}: {action: "zoom_out"},
+	{glfw.Key0, glfw.ModControl | glfw.ModShift}:     {action: "zoom_reset"},
+}
+
+// Bindings that follow the leader key, like tmux's prefix
+var leaderBindings = map[keyCombo]keyAction{}
+var leaderKey *keyCombo
+var leaderPending = false
+
+// runKeybinding runs the binding for a key press, returns false when the key
+// should be handled as terminal input
+func runKeybinding(w *glfw.Window, key glfw.Key, action glfw.Action, mods glfw.ModifierKey) bool {
+	if key >= glfw.KeyLeftShift && key <= glfw.KeyRightSuper {
+		//lone modifiers don't complete or cancel a binding
+		return false
+	}
+	combo := keyCombo{key, mods}
+
+	if leaderPending {
+		if action != glfw.Press {
+			return true
+		}
+		leaderPending = false
+		if combo == *leaderKey {
+			//leader twice sends the leader itself
+			return false
+		}
+		if binding, ok := leaderBindings[combo]; ok {
+			return runKeyAction(w, binding, action)
+		}
+		//unbound keys after the leader are dropped
+		return true
+	}
+	if leaderKey != nil && combo == *leaderKey {
+		if action == glfw.Press {
+			leaderPending = true
+		}
+		return true
+	}
+
+	if binding, ok := keybindings[combo]; ok {
+		return runKeyAction(w, binding, action)
+	}
+	return false
+}
+
+func runKeyAction(w *glfw.Window, binding keyAction, action glfw.Action) bool {
+	if binding.action == passthrough {
+		return false
+	}
+	if binding.action == "" {
+		if action == glfw.Press || term_handler.keyModes().autoRepeat {
+			sendToPty(binding.send)
+		}
+		return true
+	}
+	act, ok := actions[binding.action]
+	if !ok {
+		return false
+	}
+	if action == glfw.Press || act.repeat {
+		act.run(w)
+	}
+	return true
+}
+
+// sendToPty sends keyboard input to the program and brings the view back
+// down from the scrollback
+func sendToPty(s string) {
+	if s == "" {
+		return
+	}
+	term_handler.ScrollToBottom()
+	term_pty.WriteString(s)
+}
+
+func toggleSettings(w *glfw.Window) {
+	showui = !showui
+}
+
+func toggleFullscreen(w *glfw.Window) {
+	if w.GetMonitor() == nil {
+		w.SetMonitor(glfw.GetPrimaryMonitor(), 0, 0, glfw.GetPrimaryMonitor().GetVideoMode().Width, glfw.GetPrimaryMonitor().GetVideoMode().Height, 60)
+	} else {
+		w.SetMonitor(nil, 0, 0, int(win_dims[0]), int(win_dims[1]), 60)
+	}
+}
+
+// copyToClipboard copies the selection, or the whole screen without one
+func copyToClipboard(w *glfw.Window) {
+	th := term_handler
+	th.mu.Lock()
+	text := ""
+	if selection.active {
+		text = selection.text()
+	} else {
+		text = th.screenText()
+	}
+	th.mu.Unlock()
+	glfw.SetClipboardString(text)
+}
+
+func pasteFromClipboard(w *glfw.Window) {
+	pasteText(glfw.GetClipboardString())
+}
+
+// pasteText sends text as if typed, wrapped in bracketed paste markers
+// when the program asked for them
+func pasteText(text string) {
+	if text == "" {
+		return
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\r")
+	text = strings.ReplaceAll(text, "\n", "\r")
+	term_handler.mu.Lock()
+	bracketed := term_handler.bracketedPaste
+	term_handler.mu.Unlock()
+	if bracketed {
+		//a pasted end marker could otherwise end the paste early
+		text = strings.ReplaceAll(text, "\x1b[201~", "")
+		text = "\x1b[200~" + text + "\x1b[201~"
+	}
+	sendToPty(text)
+}
+
+// zoomWindow scales the window, a factor of 0 goes back to the starting size
+func zoomWindow(w *glfw.Window, factor float32) {
+	if w.GetMonitor() != nil {
+		return
+	}
+	width, height := default_win_dims[0], default_win_dims[1]
+	if factor != 0 {
+		width = int32(float32(win_dims[0]) * factor)
+		height = int32(float32(win_dims[1]) * factor)
+	}
+	w.SetSize(int(width), int(height))
+}
+
+// Names used for keys in the keybinding file, letters, digits and f1-f25 are
+// handled separately
+var keyNames = map[string]glfw.Key{
+	"space":         glfw.KeySpace,
+	"apostrophe":    glfw.KeyApostrophe,
+	"comma":         glfw.KeyComma,
+	"minus":         glfw.KeyMinus,
+	"period":        glfw.KeyPeriod,
+	"slash":         glfw.KeySlash,
+	"semicolon":     glfw.KeySemicolon,
+	"equal":         glfw.KeyEqual,
+	"left_bracket":  glfw.KeyLeftBracket,
+	"backslash":     glfw.KeyBackslash,
+	"right_bracket": glfw.KeyRightBracket,
+	"grave":         glfw.KeyGraveAccent,
+	"escape":        glfw.KeyEscape,
+	"enter":         glfw.KeyEnter,
+	"tab":           glfw.KeyTab,
+	"backspace":     glfw.KeyBackspace,
+	"insert":        glfw.KeyInsert,
+	"delete":        glfw.KeyDelete,
+	"right":         glfw.KeyRight,
+	"left":          glfw.KeyLeft,
+	"down":          glfw.KeyDown,
+	"up":            glfw.KeyUp,
+	"page_up":       glfw.KeyPageUp,
+	"page_down":     glfw.KeyPageDown,
+	"home":          glfw.KeyHome,
+	"end":           glfw.KeyEnd,
+	"pause":         glfw.KeyPause,
+	"print_screen":  glfw.KeyPrintScreen,
+	"menu":          glfw.KeyMenu,
+}
+
+var modNames = map[string]glfw.ModifierKey{
+	"shift": glfw.ModShift,
+	"ctrl":  glfw.ModControl,
+	"alt":   glfw.ModAlt,
+	"super": glfw.ModSuper,
+}
+
+// parseKeyCombo reads combos such as ctrl+shift+c, f11 or shift+page_up
+func parseKeyCombo(s string) (keyCombo, error) {
+	parts := strings.Split(strings.ToLower(s), "+")
+	combo := keyCombo{}
+	for _, part := range parts[:len(parts)-1] {
+		mod, ok := modNames[part]
+		if !ok {
+			return combo, fmt.Errorf("unknown modifier %q", part)
+		}
+		combo.mod |= mod
+	}
+	name := parts[len(parts)-1]
+	if key, ok := keyNames[name]; ok {
+		combo.key = key
+		return combo, nil
+	}
+	if len(name) == 1 && ((name[0] >= 'a' && name[0] <= 'z') || (name[0] >= '0' && name[0] <= '9')) {
+		//GLFW key tokens for letters and digits are their upper case ASCII
+		combo.key = glfw.Key(strings.ToUpper(name)[0])
+		return combo, nil
+	}
+	if n, err := strconv.Atoi(strings.TrimPrefix(name, "f")); err == nil && name[0] == 'f' && n >= 1 && n <= 25 {
+		combo.key = glfw.KeyF1 + glfw.Key(n-1)
+		return combo, nil
+	}
+	return combo, fmt.Errorf("unknown key %q", name)
+}
+
+// comboName is the reverse of parseKeyCombo, used for the settings guide
+func comboName(combo keyCombo) string {
+	name := ""
+	for _, mod := range []string{"ctrl", "alt", "super", "shift"} {
+		if combo.mod&modNames[mod] != 0 {
+			name += strings.ToUpper(mod[:1]) + mod[1:] + " + "
+		}
+	}
+	switch {
+	case combo.key >= glfw.KeyF1 && combo.key <= glfw.KeyF25:
+		return name + fmt.Sprintf("F%d", combo.key-glfw.KeyF1+1)
+	case (combo.key >= glfw.KeyA && combo.key <= glfw.KeyZ) || (combo.key >= glfw.Key0 && combo.key <= glfw.Key9):
+		return name + string(rune(combo.key))
+	}
+	for n, key := range keyNames {
+		if key == combo.key {
+			return name + strings.ToUpper(n[:1]) + strings.ReplaceAll(n[1:], "_", " ")
+		}
+	}
+	return name + "?"
+}
+
+// bindingFor finds a key bound to the named action
+func bindingFor(action string) (string, bool) {
+	for combo, binding := range keybindings {
+		if binding.action == action {
+			return comboName(combo), true
+		}
+	}
+	for combo, binding := range leaderBindings {
+		if binding.action == action && leaderKey != nil {
+			return comboName(*leaderKey) + ", " + comboName(combo), true
+		}
+	}
+	return "", false
+}
+
+// loadKeybindings reads a keybinding file on top of the defaults. Each line
+// is a key combo followed by an action name, passthrough or a quoted string
+// to send, a combo starting with "leader" is bound after the leader key:
+//
+//	leader ctrl+a
+//	leader c       copy
+//	ctrl+s         passthrough
+//	ctrl+alt+l     "ls -l\n"
+func loadKeybindings(path string) error {
+	return readConfigLines(path, func(line string, lineNum int) {
+		fields := strings.Fields(line)
+		rest := line
+		bindings := keybindings
+		if fields[0] == "leader" {
+			if len(fields) == 2 {
+				combo, err := parseKeyCombo(fields[1])
+				if err != nil {
+					log.Printf("%s:%d: %s", path, lineNum, err)
+					return
+				}
+				leaderKey = &combo
+				return
+			}
+			bindings = leaderBindings
+			fields = fields[1:]
+			rest = strings.TrimSpace(strings.TrimPrefix(rest, "leader"))
+		}
+		if len(fields) < 2 {
+			log.Printf("%s:%d: expected a key and an action", path, lineNum)
+			return
+		}
+		combo, err := parseKeyCombo(fields[0])
+		if err != nil {
+			log.Printf("%s:%d: %s", path, lineNum, err)
+			return
+		}
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, fields[0]))
+		switch {
+		case strings.HasPrefix(rest, "\""):
+			text, err := strconv.Unquote(rest)
+			if err != nil {
+				log.Printf("%s:%d: bad string %s", path, lineNum, rest)
+				return
+			}
+			bindings[combo] = keyAction{send: text}
+		case rest == passthrough:
+			bindings[combo] = keyAction{action: passthrough}
+		default:
+			if _, ok := actions[rest]; !ok {
+				log.Printf("%s:%d: unknown action %q", path, lineNum, rest)
+				return
+			}
+			bindings[combo] = keyAction{action: rest}
+		}
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+func TestParseKeyCombo(t *testing.T) {
+	tests := []struct {
+		s    string
+		want keyCombo
+		ok   bool
+	}{
+		{"ctrl+shift+c", keyCombo{glfw.KeyC, glfw.ModControl | glfw.ModShift}, true},
+		{"Ctrl+Shift+C", keyCombo{glfw.KeyC, glfw.ModControl | glfw.ModShift}, true},
+		{"a", keyCombo{glfw.KeyA, 0}, true},
+		{"alt+1", keyCombo{glfw.Key1, glfw.ModAlt}, true},
+		{"f11", keyCombo{glfw.KeyF11, 0}, true},
+		{"F3", keyCombo{glfw.KeyF3, 0}, true},
+		{"super+f25", keyCombo{glfw.KeyF25, glfw.ModSuper}, true},
+		{"shift+page_up", keyCombo{glfw.KeyPageUp, glfw.ModShift}, true},
+		{"ctrl+left_bracket", keyCombo{glfw.KeyLeftBracket, glfw.ModControl}, true},
+		{"hyper+a", keyCombo{}, false},
+		{"ctrl+nokey", keyCombo{}, false},
+		{"f26", keyCombo{}, false},
+		{"f0", keyCombo{}, false},
+		{"ctrl+", keyCombo{}, false},
+		{"", keyCombo{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseKeyCombo(tt.s)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("parseKeyCombo(%q) = %+v, %v, want %+v, ok %v", tt.s, got, err, tt.want, tt.ok)
+		}
+	}
+}
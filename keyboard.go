@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// Final characters of the cursor keys, sent as CSI x normally or SS3 x when
+// the application has enabled cursor key mode (DECCKM)
+var cursorKeys = map[glfw.Key]byte{
+	glfw.KeyUp:    'A',
+	glfw.KeyDown:  'B',
+	glfw.KeyRight: 'C',
+	glfw.KeyLeft:  'D',
+	glfw.KeyHome:  'H',
+	glfw.KeyEnd:   'F',
+}
+
+// F1-F4 are SS3 P-S without modifiers and CSI 1;m P-S with them
+var pfKeys = map[glfw.Key]byte{
+	glfw.KeyF1: 'P',
+	glfw.KeyF2: 'Q',
+	glfw.KeyF3: 'R',
+	glfw.KeyF4: 'S',
+}
+
+// Keys sent as CSI n ~ or CSI n;m ~
+var tildeKeys = map[glfw.Key]int{
+	glfw.KeyInsert:   2,
+	glfw.KeyDelete:   3,
+	glfw.KeyPageUp:   5,
+	glfw.KeyPageDown: 6,
+	glfw.KeyF5:       15,
+	glfw.KeyF6:       17,
+	glfw.KeyF7:       18,
+	glfw.KeyF8:       19,
+	glfw.KeyF9:       20,
+	glfw.KeyF10:      21,
+	glfw.KeyF11:      23,
+	glfw.KeyF12:      24,
+}
+
+// Keypad keys in application keypad mode (DECKPAM) are SS3 x
+var keypadApplication = map[glfw.Key]byte{
+	glfw.KeyKP0:        'p',
+	glfw.KeyKP1:        'q',
+	glfw.KeyKP2:        'r',
+	glfw.KeyKP3:        's',
+	glfw.KeyKP4:        't',
+	glfw.KeyKP5:        'u',
+	glfw.KeyKP6:        'v',
+	glfw.KeyKP7:        'w',
+	glfw.KeyKP8:        'x',
+	glfw.KeyKP9:        'y',
+	glfw.KeyKPDecimal:  'n',
+	glfw.KeyKPDivide:   'o',
+	glfw.KeyKPMultiply: 'j',
+	glfw.KeyKPSubtract: 'm',
+	glfw.KeyKPAdd:      'k',
+	glfw.KeyKPEnter:    'M',
+	glfw.KeyKPEqual:    'X',
+}
+
+// With num lock off the keypad digits act as the navigation keys printed on them
+var keypadNavigation = map[glfw.Key]glfw.Key{
+	glfw.KeyKP0:       glfw.KeyInsert,
+	glfw.KeyKP1:       glfw.KeyEnd,
+	glfw.KeyKP2:       glfw.KeyDown,
+	glfw.KeyKP3:       glfw.KeyPageDown,
+	glfw.KeyKP4:       glfw.KeyLeft,
+	glfw.KeyKP6:       glfw.KeyRight,
+	glfw.KeyKP7:       glfw.KeyHome,
+	glfw.KeyKP8:       glfw.KeyUp,
+	glfw.KeyKP9:       glfw.KeyPageUp,
+	glfw.KeyKPDecimal: glfw.KeyDelete,
+}
+
+// When true Alt sends an ESC before the key, otherwise it sets the 8th bit
+var metaSendsEscape = true
+
+// Whether Alt makes typed text Meta. Off on macOS, where Option types
+// characters of the layout such as @ on German keyboards
+var altIsMeta = runtime.GOOS != "darwin"
+
+// set when a key press was already sent so the text that follows it
+// from charCall should be dropped
+var suppressChar = false
+
+// xterm modifier parameter: 1 + shift(1) + alt(2) + ctrl(4) + super(8)
+func modifierParam(mods glfw.ModifierKey) int {
+	param := 1
+	if mods&glfw.ModShift != 0 {
+		param += 1
+	}
+	if mods&glfw.ModAlt != 0 {
+		param += 2
+	}
+	if mods&glfw.ModControl != 0 {
+		param += 4
+	}
+	if mods&glfw.ModSuper != 0 {
+		param += 8
+	}
+	return param
+}
+
+// keyModes are the modes programs set that change what keys send. The
+// parser changes them as output arrives, so they are read together under
+// the lock
+type keyModes struct {
+	flags         int //kitty keyboard enhancements of the active screen
+	autoRepeat    bool
+	appKeypad     bool
+	appCursorKeys bool
+}
+
+func (th *termHandler) keyModes() keyModes {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	return keyModes{th.keyboardFlags(), th.autoRepeat, th.appKeypad, th.appCursorKeys}
+}
+
+// keySequence returns the xterm sequence for a function, navigation or keypad key
+func keySequence(key glfw.Key, mods glfw.ModifierKey, modes keyModes) (string, bool) {
+	numlock := mods&glfw.ModNumLock != 0
+	mods &^= glfw.ModCapsLock | glfw.ModNumLock
+
+	if nav, ok := keypadNavigation[key]; ok && !numlock {
+		key = nav
+	}
+	if key == glfw.KeyKP5 && !numlock {
+		//Begin
+		if mods == 0 {
+			return "\x1b[E", true
+		}
+		return fmt.Sprintf("\x1b[1;%dE", modifierParam(mods)), true
+	}
+
+	if final, ok := keypadApplication[key]; ok {
+		if modes.appKeypad {
+			suppressChar = key != glfw.KeyKPEnter
+			if mods == 0 {
+				return "\x1bO" + string(final), true
+			}
+			return fmt.Sprintf("\x1bO%d%c", modifierParam(mods), final), true
+		}
+		if key == glfw.KeyKPEnter {
+			return "\r", true
+		}
+		//Everything else is text and comes through charCall
+		return "", false
+	}
+
+	if final, ok := cursorKeys[key]; ok {
+		if mods != 0 {
+			return fmt.Sprintf("\x1b[1;%d%c", modifierParam(mods), final), true
+		}
+		if modes.appCursorKeys {
+			return "\x1bO" + string(final), true
+		}
+		return "\x1b[" + string(final), true
+	}
+	if final, ok := pfKeys[key]; ok {
+		if mods != 0 {
+			return fmt.Sprintf("\x1b[1;%d%c", modifierParam(mods), final), true
+		}
+		return "\x1bO" + string(final), true
+	}
+	if n, ok := tildeKeys[key]; ok {
+		if mods != 0 {
+			return fmt.Sprintf("\x1b[%d;%d~", n, modifierParam(mods)), true
+		}
+		return fmt.Sprintf("\x1b[%d~", n), true
+	}
+	return "", false
+}
+
+// metaEncode applies the Alt modifier to the text of a key
+func metaEncode(str string) string {
+	if !metaSendsEscape && len(str) == 1 && str[0] < 0x80 {
+		//8th bit set, encoded as UTF-8 like xterm does
+		return string(rune(str[0] | 0x80))
+	}
+	return "\x1b" + str
+}
+
+// controlCode returns the C0 control character for Ctrl and a key. The
+// layout's name for the key is used so Ctrl+A follows the A on the keycap
+func controlCode(key glfw.Key, scancode int) (byte, bool) {
+	var ch byte
+	if name := glfw.GetKeyName(key, scancode); len(name) == 1 {
+		ch = name[0]
+	} else if key >= glfw.KeySpace && key < 0x80 {
+		//Printable key tokens match their US ASCII character
+		ch = byte(key)
+	} else {
+		return 0, false
+	}
+	return controlChar(ch)
+}
+
+// controlChar is the C0 control character Ctrl makes of a key's character
+func controlChar(ch byte) (byte, bool) {
+	if ch >= 'A' && ch <= 'Z' {
+		ch += 'a' - 'A'
+	}
+
+	switch {
+	case ch >= 'a' && ch <= 'z':
+		return ch - 'a' + 1, true
+	case ch == ' ' || ch == '@' || ch == '2':
+		return 0x00, true
+	case ch == '[' || ch == '3':
+		return 0x1b, true
+	case ch == '\\' || ch == '4':
+		return 0x1c, true
+	case ch == ']' || ch == '5':
+		return 0x1d, true
+	case ch == '^' || ch == '~' || ch == '6':
+		return 0x1e, true
+	case ch == '_' || ch == '-' || ch == '/' || ch == '7':
+		return 0x1f, true
+	case ch == '?' || ch == '8':
+		return 0x7f, true
+	}
+	return 0, false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+func TestKeySequence(t *testing.T) {
+	const (
+		shift   = glfw.ModShift
+		ctrl    = glfw.ModControl
+		alt     = glfw.ModAlt
+		numlock = glfw.ModNumLock
+	)
+	appCursor := keyModes{appCursorKeys: true}
+	appKeypad := keyModes{appKeypad: true}
+	tests := []struct {
+		key   glfw.Key
+		mods  glfw.ModifierKey
+		modes keyModes
+		want  string
+		ok    bool
+	}{
+		{glfw.KeyRight, 0, keyModes{}, "\x1b[C", true},
+		{glfw.KeyRight, 0, appCursor, "\x1bOC", true},
+		{glfw.KeyRight, ctrl, appCursor, "\x1b[1;5C", true},
+		{glfw.KeyUp, shift | alt, keyModes{}, "\x1b[1;4A", true},
+		{glfw.KeyHome, 0, keyModes{}, "\x1b[H", true},
+		{glfw.KeyF1, 0, keyModes{}, "\x1bOP", true},
+		{glfw.KeyF4, shift, keyModes{}, "\x1b[1;2S", true},
+		{glfw.KeyF3, 0, keyModes{}, "\x1bOR", true},
+		{glfw.KeyF5, shift, keyModes{}, "\x1b[15;2~", true},
+		{glfw.KeyF12, 0, keyModes{}, "\x1b[24~", true},
+		{glfw.KeyDelete, 0, keyModes{}, "\x1b[3~", true},
+		{glfw.KeyPageUp, ctrl, keyModes{}, "\x1b[5;5~", true},
+		{glfw.KeyKP1, 0, keyModes{}, "\x1b[F", true},
+		{glfw.KeyKP5, 0, keyModes{}, "\x1b[E", true},
+		{glfw.KeyKP5, ctrl, keyModes{}, "\x1b[1;5E", true},
+		{glfw.KeyKP1, numlock, keyModes{}, "", false},
+		{glfw.KeyKP1, numlock, appKeypad, "\x1bOq", true},
+		{glfw.KeyKPEnter, 0, keyModes{}, "\r", true},
+		{glfw.KeyKPEnter, 0, appKeypad, "\x1bOM", true},
+		{glfw.KeyA, 0, keyModes{}, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := keySequence(tt.key, tt.mods, tt.modes)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("keySequence(%d, %d, %+v) = %q, %v, want %q, %v", tt.key, tt.mods, tt.modes, got, ok, tt.want, tt.ok)
+		}
+	}
+	suppressChar = false
+}
+
+func TestControlChar(t *testing.T) {
+	tests := []struct {
+		ch   byte
+		want byte
+		ok   bool
+	}{
+		{'a', 0x01, true},
+		{'z', 0x1a, true},
+		{'Z', 0x1a, true},
+		{'c', 0x03, true},
+		{' ', 0x00, true},
+		{'@', 0x00, true},
+		{'2', 0x00, true},
+		{'[', 0x1b, true},
+		{'3', 0x1b, true},
+		{'\\', 0x1c, true},
+		{']', 0x1d, true},
+		{'^', 0x1e, true},
+		{'6', 0x1e, true},
+		{'_', 0x1f, true},
+		{'/', 0x1f, true},
+		{'?', 0x7f, true},
+		{'8', 0x7f, true},
+		{'1', 0, false},
+		{'=', 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := controlChar(tt.ch); got != tt.want || ok != tt.ok {
+			t.Errorf("controlChar(%q) = %#x, %v, want %#x, %v", tt.ch, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMetaEncode(t *testing.T) {
+	defer func(saved bool) { metaSendsEscape = saved }(metaSendsEscape)
+	tests := []struct {
+		escape bool
+		in     string
+		want   string
+	}{
+		{true, "x", "\x1bx"},
+		{true, "\r", "\x1b\r"},
+		{true, "é", "\x1bé"},
+		{false, "x", "ø"},
+		{false, "\x01", "\u0081"},
+		{false, "é", "\x1bé"},
+	}
+	for _, tt := range tests {
+		metaSendsEscape = tt.escape
+		if got := metaEncode(tt.in); got != tt.want {
+			t.Errorf("metaEncode(%q) with escape %v = %q, want %q", tt.in, tt.escape, got, tt.want)
+		}
+	}
+}
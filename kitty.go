@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// Progressive enhancement flags of the kitty keyboard protocol
+// https://sw.kovidgoyal.net/kitty/keyboard-protocol/
+const (
+	kittyDisambiguate   = 1
+	kittyEventTypes     = 2
+	kittyAlternateKeys  = 4
+	kittyAllKeys        = 8
+	kittyAssociatedText = 16
+
+	kittySupported = kittyDisambiguate | kittyEventTypes | kittyAllKeys
+	kittyStackSize = 16
+)
+
+// Keys reported as CSI code u
+var kittyKeyCodes = map[glfw.Key]int{
+	glfw.KeyEscape:    27,
+	glfw.KeyEnter:     13,
+	glfw.KeyTab:       9,
+	glfw.KeyBackspace: 127,
+
+	glfw.KeyCapsLock:    57358,
+	glfw.KeyScrollLock:  57359,
+	glfw.KeyNumLock:     57360,
+	glfw.KeyPrintScreen: 57361,
+	glfw.KeyPause:       57362,
+	glfw.KeyMenu:        57363,
+
+	glfw.KeyKP0:        57399,
+	glfw.KeyKP1:        57400,
+	glfw.KeyKP2:        57401,
+	glfw.KeyKP3:        57402,
+	glfw.KeyKP4:        57403,
+	glfw.KeyKP5:        57404,
+	glfw.KeyKP6:        57405,
+	glfw.KeyKP7:        57406,
+	glfw.KeyKP8:        57407,
+	glfw.KeyKP9:        57408,
+	glfw.KeyKPDecimal:  57409,
+	glfw.KeyKPDivide:   57410,
+	glfw.KeyKPMultiply: 57411,
+	glfw.KeyKPSubtract: 57412,
+	glfw.KeyKPAdd:      57413,
+	glfw.KeyKPEnter:    57414,
+	glfw.KeyKPEqual:    57415,
+
+	glfw.KeyLeftShift:    57441,
+	glfw.KeyLeftControl:  57442,
+	glfw.KeyLeftAlt:      57443,
+	glfw.KeyLeftSuper:    57444,
+	glfw.KeyRightShift:   57447,
+	glfw.KeyRightControl: 57448,
+	glfw.KeyRightAlt:     57449,
+	glfw.KeyRightSuper:   57450,
+}
+
+// Keypad keys with num lock off
+var kittyKeypadNavigation = map[glfw.Key]int{
+	glfw.KeyKP4:       57417,
+	glfw.KeyKP6:       57418,
+	glfw.KeyKP8:       57419,
+	glfw.KeyKP2:       57420,
+	glfw.KeyKP9:       57421,
+	glfw.KeyKP3:       57422,
+	glfw.KeyKP7:       57423,
+	glfw.KeyKP1:       57424,
+	glfw.KeyKP0:       57425,
+	glfw.KeyKPDecimal: 57426,
+	glfw.KeyKP5:       57427,
+}
+
+// keyboardFlags are the enhancement flags of the active screen, the input
+// side reads them through keyModes
+func (mw *termHandler) keyboardFlags() int {
+	stack := mw.kittyFlags[mw.screenIndex()]
+	if len(stack) == 0 {
+		return 0
+	}
+	return stack[len(stack)-1]
+}
+
+// screenIndex is 0 for the main screen and 1 for the alternate screen
+func (mw *termHandler) screenIndex() int {
+	if mw.useAlternate {
+		return 1
+	}
+	return 0
+}
+
+// handleKittyKeyboard handles CSI > flags u, CSI < n u, CSI = flags ; mode u and CSI ? u
+func (mw *termHandler) handleKittyKeyboard(code string) {
+	screen := mw.screenIndex()
+	stack := mw.kittyFlags[screen]
+	body := code[2 : len(code)-1]
+	switch code[1] {
+	case '>':
+		flags := csiParams(body, 0)[0] & kittySupported
+		if len(stack) >= kittyStackSize {
+			stack = stack[1:]
+		}
+		stack = append(stack, flags)
+	case '<':
+		n := csiParams(body, 1)[0]
+		if n > len(stack) {
+			n = len(stack)
+		}
+		stack = stack[:len(stack)-n]
+	case '=':
+		params := csiParams(body, 1)
+		flags := params[0] & kittySupported
+		if len(stack) == 0 {
+			stack = append(stack, 0)
+		}
+		mode := 1
+		if len(params) > 1 {
+			mode = params[1]
+		}
+		switch mode {
+		case 1:
+			stack[len(stack)-1] = flags
+		case 2:
+			stack[len(stack)-1] |= flags
+		case 3:
+			stack[len(stack)-1] &^= flags
+		}
+	case '?':
+		mw.reply(fmt.Sprintf("\x1b[?%du", mw.keyboardFlags()))
+	}
+	mw.kittyFlags[screen] = stack
+}
+
+// kittyKeySequence encodes a key event for the active enhancement flags.
+// handled is false when the key should go through the legacy encoding,
+// a handled key with an empty sequence sends nothing
+func kittyKeySequence(key glfw.Key, scancode int, action glfw.Action, mods glfw.ModifierKey, flags int) (seq string, handled bool) {
+	if action == glfw.Release && flags&kittyEventTypes == 0 {
+		return "", true
+	}
+	numlock := mods&glfw.ModNumLock != 0
+	modParam := modifierParam(mods &^ (glfw.ModCapsLock | glfw.ModNumLock))
+	if flags&kittyAllKeys != 0 {
+		if mods&glfw.ModCapsLock != 0 {
+			modParam += 64
+		}
+		if numlock {
+			modParam += 128
+		}
+	}
+	event := 1
+	if flags&kittyEventTypes != 0 {
+		if action == glfw.Repeat {
+			event = 2
+		} else if action == glfw.Release {
+			event = 3
+		}
+	}
+	//modifiers and event type, left out when they are the defaults
+	suffix := ""
+	if event != 1 {
+		suffix = fmt.Sprintf(";%d:%d", modParam, event)
+	} else if modParam != 1 {
+		suffix = fmt.Sprintf(";%d", modParam)
+	}
+	plain := modParam == 1
+
+	//Functional keys keep their legacy form
+	if key == glfw.KeyF3 {
+		return "\x1b[13" + suffix + "~", true
+	}
+	final, ok := cursorKeys[key]
+	if !ok {
+		final, ok = pfKeys[key]
+	}
+	if ok {
+		if suffix == "" {
+			return "\x1b[" + string(final), true
+		}
+		return "\x1b[1" + suffix + string(final), true
+	}
+	if n, ok := tildeKeys[key]; ok {
+		return fmt.Sprintf("\x1b[%d%s~", n, suffix), true
+	}
+	if key >= glfw.KeyF13 && key <= glfw.KeyF25 {
+		return fmt.Sprintf("\x1b[%d%su", 57376+int(key-glfw.KeyF13), suffix), true
+	}
+
+	if code, ok := kittyKeyCodes[key]; ok {
+		if nav, ok := kittyKeypadNavigation[key]; ok && !numlock {
+			code = nav
+		}
+		if flags&kittyAllKeys == 0 {
+			switch {
+			case key >= glfw.KeyLeftShift && key <= glfw.KeyRightSuper, key >= glfw.KeyCapsLock && key <= glfw.KeyNumLock:
+				//Modifier and lock keys are only reported with all keys
+				return "", true
+			case key == glfw.KeyEnter || key == glfw.KeyTab || key == glfw.KeyBackspace:
+				if action == glfw.Release {
+					return "", true
+				}
+				if plain {
+					return "", false
+				}
+			case key >= glfw.KeyKP0 && key <= glfw.KeyKPEqual && key != glfw.KeyKPEnter:
+				_, navigation := kittyKeypadNavigation[key]
+				text := !navigation || numlock
+				if text && plain && action != glfw.Release {
+					return "", false
+				}
+			}
+		}
+		return fmt.Sprintf("\x1b[%d%su", code, suffix), true
+	}
+
+	//Text keys are identified by the unshifted character of the layout
+	name := glfw.GetKeyName(key, scancode)
+	r, size := utf8.DecodeRuneInString(name)
+	if name == "" || size != len(name) {
+		if key == glfw.KeySpace {
+			r = ' '
+		} else {
+			return "", false
+		}
+	}
+	if flags&kittyAllKeys == 0 && action != glfw.Release {
+		if mods&(glfw.ModControl|glfw.ModAlt|glfw.ModSuper) == 0 {
+			//Plain and shifted text stays text
+			return "", false
+		}
+	}
+	return fmt.Sprintf("\x1b[%d%su", r, suffix), true
+}
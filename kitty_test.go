@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+func TestKittyKeySequence(t *testing.T) {
+	const (
+		press   = glfw.Press
+		repeat  = glfw.Repeat
+		release = glfw.Release
+		shift   = glfw.ModShift
+		ctrl    = glfw.ModControl
+		caps    = glfw.ModCapsLock
+		numlock = glfw.ModNumLock
+		events  = kittyDisambiguate | kittyEventTypes
+	)
+	tests := []struct {
+		key    glfw.Key
+		action glfw.Action
+		mods   glfw.ModifierKey
+		flags  int
+		want   string
+		ok     bool
+	}{
+		{glfw.KeyEscape, press, 0, kittyDisambiguate, "\x1b[27u", true},
+		{glfw.KeyEnter, press, 0, kittyDisambiguate, "", false},
+		{glfw.KeyEnter, press, ctrl, kittyDisambiguate, "\x1b[13;5u", true},
+		{glfw.KeyEnter, press, 0, kittyAllKeys, "\x1b[13u", true},
+		{glfw.KeyF3, press, 0, kittyDisambiguate, "\x1b[13~", true},
+		{glfw.KeyF3, press, shift, kittyDisambiguate, "\x1b[13;2~", true},
+		{glfw.KeyF5, press, shift, kittyDisambiguate, "\x1b[15;2~", true},
+		{glfw.KeyF13, press, 0, kittyDisambiguate, "\x1b[57376u", true},
+		{glfw.KeyRight, press, 0, kittyDisambiguate, "\x1b[C", true},
+		{glfw.KeyRight, press, ctrl, kittyDisambiguate, "\x1b[1;5C", true},
+		{glfw.KeyRight, release, 0, kittyDisambiguate, "", true},
+		{glfw.KeyRight, release, 0, events, "\x1b[1;1:3C", true},
+		{glfw.KeyRight, repeat, 0, events, "\x1b[1;1:2C", true},
+		{glfw.KeyLeftShift, press, 0, kittyDisambiguate, "", true},
+		{glfw.KeyLeftShift, press, 0, kittyAllKeys, "\x1b[57441u", true},
+		{glfw.KeyCapsLock, press, caps, kittyAllKeys, "\x1b[57358;65u", true},
+		{glfw.KeyCapsLock, press, caps, kittyDisambiguate, "", true},
+		{glfw.KeyMenu, press, 0, kittyDisambiguate, "\x1b[57363u", true},
+		{glfw.KeyKP1, press, numlock, kittyDisambiguate, "", false},
+		{glfw.KeyKP1, press, 0, kittyDisambiguate, "\x1b[57424u", true},
+		{glfw.KeyKP1, press, numlock, kittyAllKeys, "\x1b[57400;129u", true},
+	}
+	for _, tt := range tests {
+		got, ok := kittyKeySequence(tt.key, 0, tt.action, tt.mods, tt.flags)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("kittyKeySequence(%d, %d, %d, %d) = %q, %v, want %q, %v", tt.key, tt.action, tt.mods, tt.flags, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestKittyFlagStack(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int
+	}{
+		{"\x1b[>1u", 1},
+		{"\x1b[>1u\x1b[>8u", 8},
+		{"\x1b[>1u\x1b[>8u\x1b[<u", 1},
+		{"\x1b[>1u\x1b[<5u", 0},
+		{"\x1b[>4u", 0}, //alternate keys aren't supported
+		{"\x1b[=3u", 3},
+		{"\x1b[=1u\x1b[=8;2u", 9},
+		{"\x1b[=11u\x1b[=1;3u", 10},
+		{"\x1b[>1u\x1b[?1049h", 0},
+		{"\x1b[>1u\x1b[?1049h\x1b[>8u\x1b[?1049l", 1},
+	}
+	for _, tt := range tests {
+		th := testTerminal()
+		th.Write([]byte(tt.input))
+		if got := th.keyboardFlags(); got != tt.want {
+			t.Errorf("%q left flags %d, want %d", tt.input, got, tt.want)
+		}
+	}
+
+	th := testTerminal()
+	for i := 0; i < kittyStackSize+4; i++ {
+		th.Write([]byte("\x1b[>1u"))
+	}
+	if n := len(th.kittyFlags[0]); n != kittyStackSize {
+		t.Errorf("the stack grew to %d entries, want %d", n, kittyStackSize)
+	}
+}
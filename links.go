@@ -0,0 +1,198 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// A linkPattern finds something clickable in the text on screen. The
+// handler is a shell command where {match} and any named group of the
+// pattern such as {file} or {line} are replaced by the text found. A
+// handler starting with "pty:" is typed into the terminal instead, without
+// pressing Enter, as whatever runs in the foreground gets the keys. A
+// group named link narrows the underlined
+// part of the match
+type linkPattern struct {
+	name    string
+	re      *regexp.Regexp
+	handler string
+}
+
+var linkPatterns = []linkPattern{
+	{"url", regexp.MustCompile(`(?:https?|ftp|file)://[^\s<>"'` + "`" + `]*[^\s<>"'` + "`" + `.,;:!?)\]]`), "xdg-open {match}"},
+	{"file", regexp.MustCompile(`(?P<file>[\w.\-~/]*\w\.\w+):(?P<line>\d+)(?::(?P<col>\d+))?`), "pty:${EDITOR:-vi} +{line} {file}"},
+	{"path", regexp.MustCompile(`(?:^|[\s'"(=])(?P<link>(?P<file>(?:~|/)[\w.\-/~+]*[\w/]))`), "xdg-open {file}"},
+}
+
+type link struct {
+	pattern    *linkPattern
+	line       int
+	start, end int //columns, end is exclusive
+	groups     map[string]string
+}
+
+func (l *link) contains(col, line int) bool {
+	return l != nil && l.line == line && col >= l.start && col < l.end
+}
+
+type linkCacheEntry struct {
+	version int
+	links   []link
+}
+
+// Links of each line, kept until the line changes
+var linkCache = map[int]linkCacheEntry{}
+
+// The link under the mouse, underlined when drawing
+var hoverLink *link
+
+// linksOn finds the links on a line, only rerunning the patterns when the
+// line was changed since the last time
+func linksOn(th *termHandler, n int) []link {
+	version := th.lineVersion(n)
+	if entry, ok := linkCache[n]; ok && entry.version == version {
+		return entry.links
+	}
+	row := th.line(n)
+	if row == nil {
+		delete(linkCache, n)
+		return nil
+	}
+	text := rowText(row)
+	links := []link{}
+	for p := range linkPatterns {
+		pattern := &linkPatterns[p]
+		linkGroup := pattern.re.SubexpIndex("link")
+		for _, loc := range pattern.re.FindAllStringSubmatchIndex(text, -1) {
+			l := link{pattern: pattern, line: n, groups: map[string]string{"match": text[loc[0]:loc[1]]}}
+			for i, name := range pattern.re.SubexpNames() {
+				if name != "" && loc[2*i] >= 0 {
+					l.groups[name] = text[loc[2*i]:loc[2*i+1]]
+				}
+			}
+			start, end := loc[0], loc[1]
+			if linkGroup > 0 && loc[2*linkGroup] >= 0 {
+				start, end = loc[2*linkGroup], loc[2*linkGroup+1]
+			}
+			//cells hold one rune each
+			l.start = utf8.RuneCountInString(text[:start])
+			l.end = utf8.RuneCountInString(text[:end])
+			links = append(links, l)
+		}
+	}
+	linkCache[n] = linkCacheEntry{version, links}
+	return links
+}
+
+// updateHoverLink finds the link under the mouse, called once a frame
+func updateHoverLink(w *glfw.Window) {
+	hoverLink = nil
+	if showui || selection.dragging {
+		return
+	}
+	xpos, ypos := w.GetCursorPos()
+	th := term_handler
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	col, row, inside := windowToCell(xpos, ypos)
+	if !inside {
+		return
+	}
+
+	//forget lines that have left the scrollback
+	for line := range linkCache {
+		if line < th.historyBase {
+			delete(linkCache, line)
+		}
+	}
+
+	n := th.viewLine(row)
+	links := linksOn(th, n)
+	for i := range links {
+		if links[i].contains(col, n) {
+			hoverLink = &links[i]
+			return
+		}
+	}
+}
+
+// openLink runs the handler of a link
+func openLink(l *link) {
+	cmd := l.pattern.handler
+	inPty := strings.HasPrefix(cmd, "pty:")
+	cmd = strings.TrimPrefix(cmd, "pty:")
+	for name, value := range l.groups {
+		cmd = strings.ReplaceAll(cmd, "{"+name+"}", shellQuote(expandHome(value)))
+	}
+	//groups that didn't match
+	cmd = regexp.MustCompile(`\{\w+\}`).ReplaceAllString(cmd, "''")
+
+	if inPty {
+		//left for the user to check and run, the foreground program may
+		//not be a shell
+		sendToPty(cmd)
+		return
+	}
+	go func() {
+		if err := exec.Command("sh", "-c", cmd).Run(); err != nil {
+			log.Printf("opening %s: %s", l.groups["match"], err)
+		}
+	}()
+}
+
+// expandHome does what the shell would do to a leading ~, quoting stops it
+func expandHome(s string) string {
+	if s != "~" && !strings.HasPrefix(s, "~/") {
+		return s
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return s
+	}
+	return home + s[1:]
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// loadLinkPatterns reads link patterns, one per line as a name, the regex
+// and the handler separated by " => ". A name already in use replaces the
+// built in pattern:
+//
+//	url  https?://\S+  =>  firefox {match}
+//	jira \bOPS-\d+\b   =>  xdg-open https://jira.example.com/browse/{match}
+func loadLinkPatterns(path string) error {
+	err := readConfigLines(path, func(line string, lineNum int) {
+		name, rest, _ := strings.Cut(line, " ")
+		pattern, handler, found := strings.Cut(rest, " => ")
+		if !found {
+			log.Printf("%s:%d: expected name, pattern => handler", path, lineNum)
+			return
+		}
+		re, err := regexp.Compile(strings.TrimSpace(pattern))
+		if err != nil {
+			log.Printf("%s:%d: %s", path, lineNum, err)
+			return
+		}
+		p := linkPattern{name, re, strings.TrimSpace(handler)}
+		replaced := false
+		for i := range linkPatterns {
+			if linkPatterns[i].name == name {
+				linkPatterns[i] = p
+				replaced = true
+			}
+		}
+		if !replaced {
+			linkPatterns = append(linkPatterns, p)
+		}
+	})
+	linkCache = map[int]linkCacheEntry{}
+	return err
+}
@@ -2,15 +2,18 @@ package main
 
 import (
 	_ "embed"
+	"flag"
 	"image"
 	"image/color"
 	"io"
 	"log"
+	"math"
 	"os"
 	"os/exec"
 	"os/signal"
 	"regexp"
 	"syscall"
+	"time"
 
 	"golang.org/x/term"
 
@@ -20,7 +23,6 @@ import (
 	"github.com/go-gl/glfw/v3.3/glfw"
 
 	"golang.org/x/image/font"
-	"golang.org/x/image/font/basicfont"
 	"golang.org/x/image/math/fixed"
 )
 
@@ -48,13 +50,14 @@ var screen_border_dims = [2]int32{8, 6}
 var terminal_dims = [2]int32{term_cells[0] * char_dims[0], term_cells[1] * char_dims[1]}
 var clear_col = []float32{1, 1, 1, 1}
 
-var win_dims = [2]int32{(terminal_dims[0] + term_borders_dims[0]) * 2, (terminal_dims[1] + term_borders_dims[1]) * 2}
+var default_win_dims = [2]int32{(terminal_dims[0] + term_borders_dims[0]) * 2, (terminal_dims[1] + term_borders_dims[1]) * 2}
+var win_dims = default_win_dims
 
 //var win_dims = [2]int32{1200, 600}
 
 func drawStringToImage(strs []string, operatingImage *image.RGBA, col color.RGBA) {
 	for i, str := range strs {
-		addLabel(operatingImage, int(term_borders_dims[0]), int(term_borders_dims[1])+13+i*13, str, col)
+		addLabel(operatingImage, int(term_borders_dims[0]), int(term_borders_dims[1]+char_baseline+int32(i)*char_dims[1]), str, col)
 	}
 }
 
@@ -102,7 +105,10 @@ func terminal(ptmx *os.File, mw io.Writer) error {
 const ansi1 = "[\u001B\u009B][[\\]()#;?]*(?:(?:(?:[a-zA-Z\\d]*(?:;[a-zA-Z\\d]*)*)?\u0007)|(?:(?:\\d{1,4}(?:;\\d{0,4})*)?[\\dA-PRZcf-ntqry=><~]))"
 const ansi2 = "[\u001B\u009B][[\\]()#;?]*(?:(?:(?:(?:;[-a-zA-Z\\d\\/#&.:=?%@~_]+)*|[a-zA-Z\\d]+(?:;[-a-zA-Z\\d\\/#&.:=?%@~_]*)*)?\u0007)|(?:(?:\\d{1,4}(?:;\\d{0,4})*)?[\\dA-PR-TZcf-nq-uy=><~]))"
 
-var re = regexp.MustCompile(ansi2)
+// ECMA-48 control sequences, OSC/DCS strings and the two or three byte escapes
+const ansi3 = "\x1b(?:\\[[0-?]*[ -/]*[@-~]|[\\]P_^X][^\x07\x1b]*(?:\x07|\x1b\\\\)|[ -/]*[0-~])"
+
+var re = regexp.MustCompile(ansi3)
 
 func Strip(str string) string {
 	return re.ReplaceAllString(str, "")
@@ -115,14 +121,45 @@ func FindAnsiIndex(str string) [][]int {
 }
 
 var term_pty *os.File
+var term_handler *termHandler
 
 // xos4 termius is a good font
 func main() {
 
 	log.SetFlags(0)
 	log.SetPrefix("\r")
+	fontPath := flag.String("font", "", "font file, or the name of a bundled font")
+	size := flag.Float64("font-size", 0, "font size in pixels")
+	flag.Parse()
+
 	//Rendering
-	myFontFace = basicfont.Face7x13
+	if *fontPath != "" {
+		addFont(*fontPath, float32(*size))
+	} else if *size > 0 {
+		fontSize = float32(*size)
+	}
+	if err := applyFont(); err != nil {
+		log.Println("font:", err)
+		selectFont(0)
+		applyFont()
+	}
+	win_dims = default_win_dims
+
+	if err := loadKeybindings(configPath("keys.conf")); err != nil && !os.IsNotExist(err) {
+		log.Println("keybindings:", err)
+	}
+
+	if err := loadSelectionConfig(configPath("selection.conf")); err != nil && !os.IsNotExist(err) {
+		log.Println("selection:", err)
+	}
+
+	if err := loadLinkPatterns(configPath("links.conf")); err != nil && !os.IsNotExist(err) {
+		log.Println("links:", err)
+	}
+
+	if err := loadAttentionPatterns(configPath("attention.conf")); err != nil && !os.IsNotExist(err) {
+		log.Println("attention:", err)
+	}
 
 	window := initWindow()
 	defer cleanupWindow(window)
@@ -142,6 +179,10 @@ func main() {
 	check(err)
 
 	var mw = NewTerminal(int(term_cells[0]), int(term_cells[1]), int(char_dims[0]), int(char_dims[1]))
+	term_handler = mw
+	if mw.bellSound, err = loadBell(); err != nil {
+		log.Println("bell:", err)
+	}
 	log.Println("STARTING")
 	go func() {
 		if err := terminal(ptmx, mw); err != nil {
@@ -151,7 +192,13 @@ func main() {
 		window.SetShouldClose(true)
 	}()
 
-	vao, screenProg, blur_program, operating_img, textHandle, pingHandle, pongHandle := makeGLStuff()
+	vao, screenProg, blur_program, operating_img, textHandle, pingHandle, pongHandle, glowHandle := makeGLStuff()
+	gpuPass := newTextPass(int(term_cells[0]), int(term_cells[1]))
+	persistence_program, err := BuildCompute(persistenceSrc)
+	check(err)
+	lastFrame := time.Now()
+	startTime := lastFrame
+	textOnGPU := gpuText
 	var lines []string
 
 	var frame_num = 0
@@ -161,24 +208,59 @@ func main() {
 		scanline_pos += 501
 		scanline_pos %= int32(terminal_dims[0] * terminal_dims[1])
 
+		if fontChanged() {
+			if err := applyFont(); err != nil {
+				log.Println("font:", err)
+			}
+			deleteTextures(textHandle, pingHandle, pongHandle, glowHandle)
+			operating_img, textHandle, pingHandle, pongHandle, glowHandle = makeImages()
+			mw.redraw()
+			badgeDots = 0
+		}
+
+		if gpuText != textOnGPU {
+			textOnGPU = gpuText
+			mw.redraw()
+			badgeDots = 0
+		}
+
 		if showui {
 			lines = MakeUI()
 			clearImage(operating_img, color.RGBA{0, 0, 0, 255})
 
 			drawStringToImage(lines, operating_img, color.RGBA{255, 255, 255, 255})
-		} else {
-			clearImage(operating_img, color.RGBA{0, 0, 0, 255})
-			mw.DrawToImage(operating_img)
+			overwriteTexWithImage(operating_img, textHandle, operating_img.Rect)
+			//the terminal starts from a clear image once the menu closes
+			mw.redraw()
+			badgeDots = 0
+		} else if !mw.midUpdate() {
+			updateHoverLink(window)
+			var dirty image.Rectangle
+			if gpuText {
+				gpuPass.draw(mw, textHandle)
+			} else {
+				dirty = mw.DrawToImage(operating_img)
+			}
+			if search.open {
+				dirty = dirty.Union(drawSearchPrompt(operating_img, mw))
+			}
+			dirty = dirty.Union(drawAttentionBadge(operating_img, mw))
+			overwriteTexWithImage(operating_img, textHandle, dirty)
 		}
-		overwriteTexWithImage(operating_img, textHandle)
+		bellFlash = mw.flashAmount()
+		updateAttention(window, mw)
 
 		// Do blurring
-		doCompute(blur_program, textHandle, pingHandle, terminal_dims)
-		doCompute(blur_program, pingHandle, pongHandle, terminal_dims)
+		doBloom(blur_program, textHandle, pingHandle, pongHandle)
+		now := time.Now()
+		doPersistence(persistence_program, textHandle, glowHandle, float32(now.Sub(lastFrame).Seconds()))
+		lastFrame = now
+		signalSeconds = float32(math.Mod(now.Sub(startTime).Seconds(), 600))
+		signalField = frame_num % 2
 
 		prerender()
 
-		doDrawing(screenProg, vao, scanline_pos, textHandle, pongHandle)
+		doDrawing(screenProg, vao, scanline_pos, textHandle, pongHandle, glowHandle)
 
 		//post render
 		glfw.PollEvents()
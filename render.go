@@ -156,13 +156,19 @@ func initWindow() *glfw.Window {
 	}
 	// mon := glfw.GetPrimaryMonitor()
 
-	window, err := glfw.CreateWindow(int(win_dims[0]), int(win_dims[1]), "Monitor", nil, nil)
+	window, err := glfw.CreateWindow(int(win_dims[0]), int(win_dims[1]), windowTitle, nil, nil)
 	if err != nil {
 		panic(err)
 	}
 	window.MakeContextCurrent()
 	window.SetKeyCallback(keyCall)
+	window.SetCharModsCallback(charCall)
+	//Report num lock so the keypad can switch between digits and navigation
+	window.SetInputMode(glfw.LockKeyMods, glfw.True)
 	window.SetSizeCallback(sizeCallback)
+	window.SetFocusCallback(focusCall)
+	window.SetMouseButtonCallback(mouseButtonCall)
+	window.SetCursorPosCallback(cursorPosCall)
 
 	// Important! Call gl.Init only under the presence of an active OpenGL context,
 	// i.e., after MakeContextCurrent.
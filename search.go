@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+var searchMatchBG = color.RGBA{96, 72, 24, 255}
+
+type searchMatch struct {
+	line       int //terminal line number, see termHandler.line
+	start, end int //columns, end is exclusive
+}
+
+type searchState struct {
+	open    bool
+	query   string
+	regex   bool
+	err     error
+	matches []searchMatch
+	byLine  map[int][]searchMatch
+	current int
+}
+
+var search searchState
+
+func toggleSearch(w *glfw.Window) {
+	search.open = !search.open
+	if search.open {
+		search.find()
+	}
+}
+
+// searchKey handles keys while the prompt is open. Enter goes to the next
+// older match, Shift+Enter to the next newer one and Tab switches regex mode
+func searchKey(key glfw.Key, action glfw.Action, mods glfw.ModifierKey) {
+	if action == glfw.Release {
+		return
+	}
+	switch key {
+	case glfw.KeyEscape:
+		search.open = false
+	case glfw.KeyEnter, glfw.KeyKPEnter:
+		search.find()
+		if mods&glfw.ModShift != 0 {
+			search.jump(1)
+		} else {
+			search.jump(-1)
+		}
+	case glfw.KeyBackspace:
+		if len(search.query) > 0 {
+			_, size := utf8.DecodeLastRuneInString(search.query)
+			search.query = search.query[:len(search.query)-size]
+			search.find()
+		}
+	case glfw.KeyTab:
+		search.regex = !search.regex
+		search.find()
+	}
+}
+
+func (s *searchState) addChar(char rune) {
+	s.query += string(char)
+	s.find()
+	//start from the newest match
+	s.current = len(s.matches)
+	s.jump(-1)
+}
+
+// find collects every match in history and on the screen. Plain text is
+// case insensitive unless the query has an upper case letter
+func (s *searchState) find() {
+	s.matches = nil
+	s.byLine = map[int][]searchMatch{}
+	s.err = nil
+	if s.query == "" {
+		return
+	}
+	pattern := s.query
+	if !s.regex {
+		pattern = regexp.QuoteMeta(pattern)
+		if strings.IndexFunc(s.query, unicode.IsUpper) < 0 {
+			pattern = "(?i)" + pattern
+		}
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		s.err = err
+		return
+	}
+
+	//output keeps scrolling lines into history while we look
+	th := term_handler
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	for n := th.historyBase; n < th.historyBase+len(th.history)+len(th.buffer); n++ {
+		text := rowText(th.line(n))
+		for _, loc := range re.FindAllStringIndex(text, -1) {
+			if loc[0] == loc[1] {
+				continue
+			}
+			//cells hold one rune each
+			m := searchMatch{n, utf8.RuneCountInString(text[:loc[0]]), utf8.RuneCountInString(text[:loc[1]])}
+			s.matches = append(s.matches, m)
+			s.byLine[n] = append(s.byLine[n], m)
+		}
+	}
+	if s.current >= len(s.matches) {
+		s.current = len(s.matches) - 1
+	}
+}
+
+// jump moves to the next match in dir and scrolls it into view
+func (s *searchState) jump(dir int) {
+	if len(s.matches) == 0 {
+		return
+	}
+	s.current += dir
+	if s.current < 0 {
+		s.current = len(s.matches) - 1
+	}
+	if s.current >= len(s.matches) {
+		s.current = 0
+	}
+
+	th := term_handler
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	line := s.matches[s.current].line
+	if line < th.viewLine(0) || line > th.viewLine(len(th.buffer)-1) {
+		//center the match
+		top := th.historyBase + len(th.history) - th.scrollOffset
+		th.scroll(top - line + len(th.buffer)/2)
+	}
+}
+
+// highlight reports whether a cell is part of a match and of the current one
+func (s *searchState) highlight(col, line int) (match, current bool) {
+	if !s.open {
+		return false, false
+	}
+	for _, m := range s.byLine[line] {
+		if col >= m.start && col < m.end {
+			return true, s.current >= 0 && s.current < len(s.matches) && s.matches[s.current] == m
+		}
+	}
+	return false, false
+}
+
+// drawSearchPrompt draws the prompt over the bottom line of the screen and
+// returns where it went, the line underneath is drawn again once it closes
+func drawSearchPrompt(img *image.RGBA, th *termHandler) image.Rectangle {
+	prompt := "Search: "
+	if search.regex {
+		prompt = "Search [re]: "
+	}
+	prompt += search.query + "_"
+	switch {
+	case search.err != nil:
+		prompt += "  (bad pattern)"
+	case search.query != "" && len(search.matches) == 0:
+		prompt += "  (no matches)"
+	case len(search.matches) > 0:
+		prompt += fmt.Sprintf("  (%d/%d)", search.current+1, len(search.matches))
+	}
+
+	startx := int(term_borders_dims[0])
+	starty := (len(th.buffer)-1)*th.charHeight + int(term_borders_dims[1])
+	rect := image.Rect(startx, starty, startx+len(th.buffer[0])*th.charWidth, starty+th.charHeight)
+	fillRect(rect, img, color.RGBA{255, 255, 255, 255})
+	addLabel(img, startx, starty+int(char_baseline), prompt, color.RGBA{0, 0, 0, 255})
+	th.redrawRow(len(th.buffer) - 1)
+	return rect
+}
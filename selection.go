@@ -0,0 +1,335 @@
+package main
+
+import (
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// Characters that end a word when double clicking, set in selection.conf
+var wordSeparators = " \t()[]{}<>'\"`|;,"
+
+// Clicks closer together than this count as double and triple clicks
+var multiClickTime = 400 * time.Millisecond
+
+type selectMode int
+
+const (
+	selectChars selectMode = iota
+	selectWords
+	selectLines
+)
+
+type cellPos struct {
+	col, line int //line is a terminal line number, see termHandler.line
+}
+
+func (a cellPos) before(b cellPos) bool {
+	return a.line < b.line || (a.line == b.line && a.col < b.col)
+}
+
+type selectionState struct {
+	active   bool
+	dragging bool
+	block    bool //rectangular selection with Alt
+	mode     selectMode
+
+	anchor, head cellPos
+	start, end   cellPos //anchor and head ordered and expanded to the mode
+
+	clicks    int
+	lastClick time.Time
+	lastPos   cellPos
+}
+
+var selection selectionState
+
+// windowToCell maps a position in the window to a cell of the view through
+// the same border geometry the screen shader uses, callers hold
+// term_handler.mu
+func windowToCell(xpos, ypos float64) (col, row int, inside bool) {
+	S := [2]float64{float64(terminal_dims[0]), float64(terminal_dims[1])}
+	P := [2]float64{float64(screen_border_dims[0]), float64(screen_border_dims[1])}
+	//UV as in full_screen_quad.frag, y already points down
+	u := xpos / float64(win_dims[0])
+	v := ypos / float64(win_dims[1])
+	u = u*(S[0]+2*P[0])/S[0] - P[0]/S[0]
+	v = v*(S[1]+2*P[1])/S[1] - P[1]/S[1]
+	u, v = curve(u, v)
+	inside = u >= 0 && u <= 1 && v >= 0 && v <= 1
+
+	//texture pixel, the image has the terminal border around the cells
+	tx := u*float64(terminal_dims[0]+2*term_borders_dims[0]) - float64(term_borders_dims[0])
+	ty := v*float64(terminal_dims[1]+2*term_borders_dims[1]) - float64(term_borders_dims[1])
+	col = int(math.Floor(tx / float64(term_handler.charWidth)))
+	row = int(math.Floor(ty / float64(term_handler.charHeight)))
+
+	if col < 0 {
+		col = 0
+	}
+	if row < 0 {
+		row = 0
+	}
+	if col >= len(term_handler.buffer[0]) {
+		col = len(term_handler.buffer[0]) - 1
+	}
+	if row >= len(term_handler.buffer) {
+		row = len(term_handler.buffer) - 1
+	}
+	return col, row, inside
+}
+
+// curve is the curve function of full_screen_quad.frag, from a point on the
+// glass to the point of the image shown there. The curvature is symmetric
+// so it works the same with y pointing down
+func curve(u, v float64) (float64, float64) {
+	cu, cv := u-.5, v-.5
+	r2 := cu*cu + cv*cv
+	cu *= 1 + float64(curvatureX)*r2
+	cv *= 1 + float64(curvatureY)*r2
+	cu *= 1 - float64(overscan)
+	cv *= 1 - float64(overscan)
+	return cu + .5, cv + .5
+}
+
+// The selection is only touched on the main thread, but the lines it is
+// made from change as output arrives, so it is worked on under the
+// terminal lock
+
+func mouseButtonCall(w *glfw.Window, button glfw.MouseButton, action glfw.Action, mods glfw.ModifierKey) {
+	if showui {
+		return
+	}
+	th := term_handler
+	xpos, ypos := w.GetCursorPos()
+	th.mu.Lock()
+	col, row, inside := windowToCell(xpos, ypos)
+	pos := cellPos{col, th.viewLine(row)}
+	th.mu.Unlock()
+
+	switch button {
+	case glfw.MouseButtonLeft:
+		if action == glfw.Press {
+			if !inside {
+				return
+			}
+			if mods&glfw.ModControl != 0 {
+				if hoverLink != nil {
+					openLink(hoverLink)
+				}
+				return
+			}
+			now := time.Now()
+			if now.Sub(selection.lastClick) < multiClickTime && pos == selection.lastPos && selection.clicks < 3 {
+				selection.clicks++
+			} else {
+				selection.clicks = 1
+			}
+			selection.lastClick = now
+			selection.lastPos = pos
+
+			selection.mode = selectMode(selection.clicks - 1)
+			selection.block = mods&glfw.ModAlt != 0
+			selection.anchor = pos
+			selection.head = pos
+			selection.dragging = true
+			//a single click only clears, a selection needs a drag
+			selection.active = selection.mode != selectChars
+			th.mu.Lock()
+			selection.update()
+			th.mu.Unlock()
+		} else if action == glfw.Release && selection.dragging {
+			selection.dragging = false
+			if selection.active {
+				th.mu.Lock()
+				text := selection.text()
+				th.mu.Unlock()
+				glfw.SetClipboardString(text)
+				setPrimary(text)
+			}
+		}
+	case glfw.MouseButtonMiddle:
+		if action == glfw.Press {
+			pasteText(getPrimary())
+		}
+	}
+}
+
+func cursorPosCall(w *glfw.Window, xpos, ypos float64) {
+	if !selection.dragging {
+		return
+	}
+	th := term_handler
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	col, row, _ := windowToCell(xpos, ypos)
+	pos := cellPos{col, th.viewLine(row)}
+	if pos != selection.head {
+		selection.head = pos
+		selection.active = true
+		selection.update()
+	}
+}
+
+// update orders the ends of the selection and expands them to whole words
+// or lines, callers hold term_handler.mu
+func (s *selectionState) update() {
+	s.start, s.end = s.anchor, s.head
+	if s.end.before(s.start) {
+		s.start, s.end = s.end, s.start
+	}
+	switch s.mode {
+	case selectWords:
+		s.start.col = wordEdge(s.start, -1)
+		s.end.col = wordEdge(s.end, 1)
+	case selectLines:
+		s.start.col = 0
+		s.end.col = len(term_handler.buffer[0]) - 1
+	}
+}
+
+// wordEdge walks from pos in direction dir until a separator
+func wordEdge(pos cellPos, dir int) int {
+	row := term_handler.line(pos.line)
+	if row == nil {
+		return pos.col
+	}
+	isSeparator := func(c Cell) bool {
+		return c.char == "" || c.char == "\x00" || strings.Contains(wordSeparators, c.char)
+	}
+	if isSeparator(row[pos.col]) {
+		return pos.col
+	}
+	col := pos.col
+	for col+dir >= 0 && col+dir < len(row) && !isSeparator(row[col+dir]) {
+		col += dir
+	}
+	return col
+}
+
+func (s *selectionState) contains(col, line int) bool {
+	if !s.active || line < s.start.line || line > s.end.line {
+		return false
+	}
+	if s.block {
+		lo, hi := s.anchor.col, s.head.col
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		return col >= lo && col <= hi
+	}
+	if line == s.start.line && col < s.start.col {
+		return false
+	}
+	if line == s.end.line && col > s.end.col {
+		return false
+	}
+	return true
+}
+
+// text is the selected text with trailing blanks removed from each line,
+// callers hold term_handler.mu
+func (s *selectionState) text() string {
+	lines := []string{}
+	for n := s.start.line; n <= s.end.line; n++ {
+		row := term_handler.line(n)
+		if row == nil {
+			continue
+		}
+		selected := []Cell{}
+		for col := range row {
+			if s.contains(col, n) {
+				selected = append(selected, row[col])
+			}
+		}
+		lines = append(lines, rowText(selected))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// loadSelectionConfig reads settings for selecting text, a name and a
+// quoted value a line:
+//
+//	word_separators " \t()[]{}<>'\"`|;,:="
+func loadSelectionConfig(path string) error {
+	return readConfigLines(path, func(line string, lineNum int) {
+		name, value, _ := strings.Cut(line, " ")
+		value = strings.TrimSpace(value)
+		switch name {
+		case "word_separators":
+			text, err := strconv.Unquote(value)
+			if err != nil {
+				log.Printf("%s:%d: bad string %s", path, lineNum, value)
+				return
+			}
+			wordSeparators = text
+		default:
+			log.Printf("%s:%d: unknown setting %q", path, lineNum, name)
+		}
+	})
+}
+
+// Tools that can reach the PRIMARY selection, GLFW only knows the clipboard
+var primaryCopy = [][]string{
+	{"wl-copy", "--primary"},
+	{"xclip", "-selection", "primary"},
+	{"xsel", "--primary", "--input"},
+}
+var primaryPaste = [][]string{
+	{"wl-paste", "--primary", "--no-newline"},
+	{"xclip", "-selection", "primary", "-o"},
+	{"xsel", "--primary", "--output"},
+}
+
+// primaryTool finds the first usable tool, wl-* only under wayland
+func primaryTool(tools [][]string) []string {
+	for _, tool := range tools {
+		if strings.HasPrefix(tool[0], "wl-") && os.Getenv("WAYLAND_DISPLAY") == "" {
+			continue
+		}
+		if _, err := exec.LookPath(tool[0]); err == nil {
+			return tool
+		}
+	}
+	return nil
+}
+
+func setPrimary(text string) {
+	tool := primaryTool(primaryCopy)
+	if tool == nil {
+		return
+	}
+	cmd := exec.Command(tool[0], tool[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		return
+	}
+	go func() {
+		io.WriteString(stdin, text)
+		stdin.Close()
+		cmd.Wait()
+	}()
+}
+
+func getPrimary() string {
+	tool := primaryTool(primaryPaste)
+	if tool == nil {
+		//without PRIMARY fall back to the clipboard
+		return glfw.GetClipboardString()
+	}
+	out, err := exec.Command(tool[0], tool[1:]...).Output()
+	if err != nil {
+		return ""
+	}
+	return string(out)
+}
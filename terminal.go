@@ -1,25 +1,45 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/faiface/beep"
-	"golang.org/x/image/colornames"
 )
 
+const (
+	cursorBlock = iota
+	cursorUnderline
+	cursorBar
+)
+
+var cursorShapeNames = []string{"Block", "Underline", "Bar"}
+
+// Longest a program may hold back the screen with synchronized output
+var syncTimeout = 200 * time.Millisecond
+
+// Output arriving closer together than coalesceDelay is drawn as one frame,
+// unless the screen hasn't been drawn for coalesceLimit
+var coalesceDelay = 3 * time.Millisecond
+var coalesceLimit = 50 * time.Millisecond
+
+// Number of lines kept once they scroll off the top of the screen
+var scrollbackLines = 2000
+
+// TermColor is how a cell was written, colors are encoded as in colors.go
 type TermColor struct {
 	foreground int
 	background int
-}
-
-func (tc TermColor) ForegroundRGBA() color.RGBA {
-	return colornames.Wheat
-}
-func (tc TermColor) BackgroundRGBA() color.RGBA {
-	return colornames.Black
+	bold       bool
+	inverse    bool
 }
 
 type Cell struct {
@@ -27,17 +47,64 @@ type Cell struct {
 	char  string
 }
 type termHandler struct {
-	buffer, alternate [][]Cell
+	buffer, alternate [][]Cell //buffer is the screen in use
 	useAlternate      bool
+	savedX, savedY    int
+
+	history      [][]Cell //lines scrolled off the top of the main screen
+	historyBase  int      //lines dropped from the front of history
+	scrollOffset int      //lines of history in view
 
 	cursorX, cursorY int
 
 	charWidth, charHeight int
 
 	defFG, defBG  int
+	pen           TermColor //SGR style new text is written with
 	cursorEnabled bool
+	cursorStyle   int       //DECSCUSR parameter, 0 follows the settings
+	blinkStart    time.Time //blinking restarts on output so the cursor shows while typing
+
+	appCursorKeys bool //DECCKM
+	appKeypad     bool //DECKPAM
+	autoRepeat    bool //DECARM
+
+	bracketedPaste bool
+	reverseVideo   bool //DECSCNM
+
+	kittyFlags [2][]int //keyboard enhancement stack for the main and alternate screen
+
+	bellSound  *beep.Buffer //decoded once, each ring plays its own streamer
+	lastBell   time.Time
+	flashStart time.Time
+
+	attention        int    //events since the window lost focus
+	attentionPending bool   //a new event the main loop hasn't raised yet
+	focused          bool   //the window has focus, set by focusCall
+	watchTail        string //output after the last newline, matched once the line is done
+
+	held    string   //an escape sequence or character the last read ended inside of
+	replies []string //answers to queries, sent once the lock is released
+
+	//Synchronized output (mode 2026), the view is drawn from the snapshot
+	//taken when the update began until it ends or times out
+	syncActive bool
+	syncStart  time.Time
+	syncView   [][]Cell
+	syncCursor [3]int //x, view row and 1 when the cursor was enabled
+	syncs      int    //counts synchronized updates so each snapshot is drawn afresh
 
-	bellSound beep.StreamSeekCloser
+	lastWrite, lastDraw time.Time
+
+	edits     int         //counts changes to the screen
+	lineEdits map[int]int //line number to the value of edits at its last change
+
+	drawn    []rowKey   //what each screen row of the image last showed
+	drawnGap color.RGBA //the color the border was filled with, zero before it is
+
+	unknownEscapes map[string]int //sequences that weren't understood, by kind
+
+	mu sync.Mutex //held while parsing output and while drawing
 }
 
 func safePrintAns(ansi string) {
@@ -60,59 +127,493 @@ func NewTerminal(width, height int, char_width, char_height int) *termHandler {
 	}
 
 	mw := &termHandler{
-		buffer:        buf,
-		alternate:     alt,
-		useAlternate:  false,
-		cursorX:       0,
-		cursorY:       0,
-		charWidth:     char_width,
-		charHeight:    char_height,
-		cursorEnabled: true,
-		defFG:         10,
-		defBG:         12,
+		buffer:         buf,
+		alternate:      alt,
+		useAlternate:   false,
+		cursorX:        0,
+		cursorY:        0,
+		charWidth:      char_width,
+		charHeight:     char_height,
+		cursorEnabled:  true,
+		autoRepeat:     true,
+		focused:        true,
+		lineEdits:      map[int]int{},
+		unknownEscapes: map[string]int{},
+		defFG:          colorDefault,
+		defBG:          colorDefault,
 	}
 	return mw
 }
 
 func fillRect(rect image.Rectangle, img *image.RGBA, color color.RGBA) {
-	for y := rect.Min.Y; y < rect.Max.Y; y++ {
-		for x := rect.Min.X; x < rect.Max.X; x++ {
-			img.SetRGBA(x, y, color)
+	rect = rect.Intersect(img.Rect)
+	if rect.Empty() {
+		return
+	}
+	//fill the first row then copy it down
+	first := img.Pix[img.PixOffset(rect.Min.X, rect.Min.Y):img.PixOffset(rect.Max.X, rect.Min.Y)]
+	for i := 0; i < len(first); i += 4 {
+		first[i], first[i+1], first[i+2], first[i+3] = color.R, color.G, color.B, color.A
+	}
+	for y := rect.Min.Y + 1; y < rect.Max.Y; y++ {
+		copy(img.Pix[img.PixOffset(rect.Min.X, y):], first)
+	}
+}
+
+// fillBorder fills img outside of inner
+func fillBorder(img *image.RGBA, inner image.Rectangle, color color.RGBA) {
+	b := img.Rect
+	fillRect(image.Rect(b.Min.X, b.Min.Y, b.Max.X, inner.Min.Y), img, color)
+	fillRect(image.Rect(b.Min.X, inner.Max.Y, b.Max.X, b.Max.Y), img, color)
+	fillRect(image.Rect(b.Min.X, inner.Min.Y, inner.Min.X, inner.Max.Y), img, color)
+	fillRect(image.Rect(inner.Max.X, inner.Min.Y, b.Max.X, inner.Max.Y), img, color)
+}
+
+// rowKey is everything that decides how a screen row looks, a row is only
+// drawn again once its key changes
+type rowKey struct {
+	valid         bool
+	line, version int
+	cursor, shape int //column of the cursor when it shows on the row
+	reverse       bool
+	phosphor      int
+	decor         rowDecor
+}
+
+// rowDecor is the selection, search matches and link drawn over a line
+type rowDecor struct {
+	selected         bool
+	selStart, selEnd cellPos
+	selBlock         [3]int //1 for a block selection and the columns it spans
+	query            string
+	matches, current int //match count on the line and start of the current match
+	linkFrom, linkTo int
+}
+
+func decorations(line int) rowDecor {
+	d := rowDecor{current: -1, linkFrom: -1}
+	if selection.active && line >= selection.start.line && line <= selection.end.line {
+		d.selected = true
+		d.selStart, d.selEnd = selection.start, selection.end
+		if selection.block {
+			d.selBlock = [3]int{1, selection.anchor.col, selection.head.col}
 		}
 	}
+	if search.open {
+		d.query = search.query
+		d.matches = len(search.byLine[line])
+		if search.current >= 0 && search.current < len(search.matches) && search.matches[search.current].line == line {
+			d.current = search.matches[search.current].start
+		}
+	}
+	if hoverLink != nil && hoverLink.line == line {
+		d.linkFrom, d.linkTo = hoverLink.start, hoverLink.end
+	}
+	return d
 }
 
-func (th termHandler) DrawToImage(img *image.RGBA) {
-	opBuffer := th.buffer //buffer to operate on
-	//if th.useAlternate {
-	//	opBuffer = th.buffer
-	//}
+// redraw forgets what the image shows so every row is drawn next time
+func (th *termHandler) redraw() {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	th.drawn = nil
+	th.drawnGap = color.RGBA{}
+}
 
-	for y := range opBuffer {
-		for x, cell := range opBuffer[y] {
-			startx := x*th.charWidth + int(term_borders_dims[0])
-			starty := y*th.charHeight + int(term_borders_dims[1])
-			fg, bg := cell.style.ForegroundRGBA(), cell.style.BackgroundRGBA()
-			// Cursor
-			if th.cursorEnabled {
-				if x == th.cursorX && y == th.cursorY {
-					fg, bg = bg, fg
-				}
-			}
+// redrawRow has screen row y drawn next time, for things drawn over it
+func (th *termHandler) redrawRow(y int) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if y >= 0 && y < len(th.drawn) {
+		th.drawn[y] = rowKey{}
+	}
+}
+
+// frameState is how the cursor and screen are shown this frame
+type frameState struct {
+	frozen             bool //a synchronized update is drawn from its snapshot
+	cursorX, cursorRow int
+	cursorVisible      bool
+	shape              int
+}
+
+func (th *termHandler) frame() frameState {
+	f := frameState{
+		frozen:        th.syncActive && time.Since(th.syncStart) < syncTimeout,
+		cursorX:       th.cursorX,
+		cursorRow:     th.cursorY + th.scrollOffset,
+		cursorVisible: th.cursorEnabled,
+	}
+	if f.frozen {
+		f.cursorX, f.cursorRow, f.cursorVisible = th.syncCursor[0], th.syncCursor[1], th.syncCursor[2] == 1
+	}
+	shape, blink := th.cursorLook()
+	f.shape = shape
+	if blink && cursorBlinkRate > 0 {
+		period := time.Duration(float64(cursorBlinkRate) * float64(time.Second))
+		f.cursorVisible = f.cursorVisible && time.Since(th.blinkStart)%(2*period) < period
+	}
+	return f
+}
+
+// changedRow is the row shown at screen line y when it differs from what
+// was drawn last, it is then recorded as drawn
+func (th *termHandler) changedRow(y int, f frameState) ([]Cell, rowKey, bool) {
+	if len(th.drawn) != len(th.buffer) {
+		th.drawn = make([]rowKey, len(th.buffer))
+	}
+	row := th.viewRow(y)
+	key := rowKey{valid: true, line: th.viewLine(y), cursor: -1, reverse: th.reverseVideo, phosphor: phosphor}
+	key.version = th.lineVersion(key.line)
+	if f.frozen {
+		row = th.syncView[y]
+		key.version = -th.syncs
+	}
+	if f.cursorVisible && y == f.cursorRow {
+		key.cursor, key.shape = f.cursorX, f.shape
+	}
+	key.decor = decorations(key.line)
+	if key == th.drawn[y] {
+		return nil, key, false
+	}
+	th.drawn[y] = key
+	return row, key, true
+}
+
+// Lines drawn over a cell
+const (
+	cellUnderline = 1 << iota //link under the mouse
+	cellCursorUnderline
+	cellCursorBar
+)
+
+// cellLook is the colors of a cell once reverse video, search, the
+// selection and the cursor are applied
+type cellLook struct {
+	fg, bg color.RGBA
+	flags  int
+}
+
+func (th *termHandler) lookOf(x int, cell Cell, key rowKey) cellLook {
+	fg, bg := cell.style.ForegroundRGBA(), cell.style.BackgroundRGBA()
+	if th.reverseVideo {
+		fg, bg = bg, fg
+	}
+	if match, current := search.highlight(x, key.line); current {
+		fg, bg = bg, fg
+	} else if match {
+		bg = searchMatchBG
+	}
+	if selection.contains(x, key.line) {
+		fg, bg = bg, fg
+	}
+	flags := 0
+	if hoverLink.contains(x, key.line) {
+		flags |= cellUnderline
+	}
+	if x == key.cursor {
+		switch key.shape {
+		case cursorBlock:
+			fg, bg = bg, fg
+		case cursorUnderline:
+			flags |= cellCursorUnderline
+		case cursorBar:
+			flags |= cellCursorBar
+		}
+	}
+	return cellLook{fg, bg, flags}
+}
+
+// gapColor fills the pixel row between lines and the border, it is the default
+// background so reverse video turns it over along with the cells
+func (th *termHandler) gapColor() color.RGBA {
+	if th.reverseVideo {
+		return TermColor{}.ForegroundRGBA()
+	}
+	return TermColor{}.BackgroundRGBA()
+}
+
+// borderChanged is true when the border around the cells has to be filled
+// again with gap, it is then recorded as filled
+func (th *termHandler) borderChanged() (gap color.RGBA, changed bool) {
+	gap = th.gapColor()
+	if gap == th.drawnGap {
+		return gap, false
+	}
+	th.drawnGap = gap
+	return gap, true
+}
 
-			fillRect(image.Rect(startx, starty, startx+th.charWidth, starty+th.charHeight-1), img, bg)
-			if cell.char == ("\x00") {
+// DrawToImage draws the rows that changed since the last call and returns
+// the part of img that was drawn
+func (th *termHandler) DrawToImage(img *image.RGBA) image.Rectangle {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+
+	th.lastDraw = time.Now()
+	f := th.frame()
+	dirty := image.Rectangle{}
+	if gap, changed := th.borderChanged(); changed {
+		left, top := int(term_borders_dims[0]), int(term_borders_dims[1])
+		cells := image.Rect(left, top, left+len(th.buffer[0])*th.charWidth, top+len(th.buffer)*th.charHeight)
+		fillBorder(img, cells, gap)
+		dirty = img.Rect
+	}
+	for y := range th.buffer {
+		row, key, changed := th.changedRow(y, f)
+		if !changed {
+			continue
+		}
+		left, top := int(term_borders_dims[0]), y*th.charHeight+int(term_borders_dims[1])
+		rowRect := image.Rect(left, top, left+len(row)*th.charWidth, top+th.charHeight)
+		fillRect(rowRect, img, th.gapColor())
+		dirty = dirty.Union(rowRect)
+
+		for x, cell := range row {
+			startx, starty := left+x*th.charWidth, top
+			look := th.lookOf(x, cell, key)
+			fillRect(image.Rect(startx, starty, startx+th.charWidth, starty+th.charHeight-1), img, look.bg)
+			if look.flags&cellUnderline != 0 {
+				fillRect(image.Rect(startx, starty+th.charHeight-2, startx+th.charWidth, starty+th.charHeight-1), img, look.fg)
+			}
+			if look.flags&cellCursorUnderline != 0 {
+				fillRect(image.Rect(startx, starty+th.charHeight-3, startx+th.charWidth, starty+th.charHeight-1), img, look.fg)
+			}
+			if look.flags&cellCursorBar != 0 {
+				fillRect(image.Rect(startx, starty, startx+2, starty+th.charHeight-1), img, look.fg)
+			}
+			if blankChar(cell.char) {
 				continue
 			}
-			addLabel(img, startx, starty+th.charHeight-2, cell.char, fg)
+			drawGlyph(img, startx, starty, cell.char, look.fg)
+		}
+	}
+	return dirty
+}
+
+// DrawToCells writes the rows that changed since the last call into cells,
+// four values a cell of glyph, foreground, background and lines as the GPU
+// text pass reads them. It returns the first and last row written, first
+// is -1 when nothing changed, the color between lines and around the cells
+// and whether the border needs filling with it
+func (th *termHandler) DrawToCells(cells []uint32) (first, last int, gap color.RGBA, border bool) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
 
+	th.lastDraw = time.Now()
+	f := th.frame()
+	first, last = -1, -1
+	gap, border = th.borderChanged()
+	for y := range th.buffer {
+		row, key, changed := th.changedRow(y, f)
+		if !changed {
+			continue
+		}
+		if first < 0 {
+			first = y
+		}
+		last = y
+		for x, cell := range row {
+			look := th.lookOf(x, cell, key)
+			i := (y*len(row) + x) * 4
+			cells[i] = 0
+			if !blankChar(cell.char) {
+				cells[i] = uint32(glyphIndex(glyphKey{cell.char, 0}) + 1)
+			}
+			cells[i+1] = packColor(look.fg)
+			cells[i+2] = packColor(look.bg)
+			cells[i+3] = uint32(look.flags)
 		}
 	}
+	return first, last, gap, border
+}
+
+// blankChar is true for cells that draw nothing but their background
+func blankChar(char string) bool {
+	return char == "" || char == "\x00" || char == " "
+}
+
+// midUpdate is true while output is still streaming in, the last frame is
+// kept rather than drawing a half finished one
+func (th *termHandler) midUpdate() bool {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	return time.Since(th.lastWrite) < coalesceDelay && time.Since(th.lastDraw) < coalesceLimit
+}
+
+// beginSync takes the snapshot shown while a synchronized update is drawn
+func (mw *termHandler) beginSync() {
+	if mw.syncActive {
+		return
+	}
+	mw.syncActive = true
+	mw.syncs++
+	mw.syncStart = time.Now()
+	mw.syncView = make([][]Cell, len(mw.buffer))
+	for y := range mw.buffer {
+		mw.syncView[y] = append([]Cell(nil), mw.viewRow(y)...)
+	}
+	enabled := 0
+	if mw.cursorEnabled {
+		enabled = 1
+	}
+	mw.syncCursor = [3]int{mw.cursorX, mw.cursorY + mw.scrollOffset, enabled}
+}
+
+func (mw *termHandler) endSync() {
+	mw.syncActive = false
+	mw.syncView = nil
+	mw.touchAll()
+}
+
+// modeState answers DECRQM for a private mode, 1 set, 2 reset, 0 unknown
+func (mw *termHandler) modeState(mode int) int {
+	var set bool
+	switch mode {
+	case 1:
+		set = mw.appCursorKeys
+	case 5:
+		set = mw.reverseVideo
+	case 8:
+		set = mw.autoRepeat
+	case 25:
+		set = mw.cursorEnabled
+	case 1049:
+		set = mw.useAlternate
+	case 2004:
+		set = mw.bracketedPaste
+	case 2026:
+		set = mw.syncActive
+	default:
+		return 0
+	}
+	if set {
+		return 1
+	}
+	return 2
+}
+
+// cursorLook is the cursor shape and whether it blinks
+func (th *termHandler) cursorLook() (shape int, blink bool) {
+	if th.cursorStyle == 0 {
+		return cursorShape, cursorBlink
+	}
+	//1,2 block, 3,4 underline, 5,6 bar, odd numbers blink
+	return (th.cursorStyle - 1) / 2, th.cursorStyle%2 == 1
+}
+
+// viewRow is the row shown at screen line y, taking scrollback into account
+func (th *termHandler) viewRow(y int) []Cell {
+	idx := len(th.history) - th.scrollOffset + y
+	if idx < len(th.history) {
+		return th.history[idx]
+	}
+	return th.buffer[idx-len(th.history)]
+}
+
+// Lines are numbered from the start of history through the screen, the
+// number of a line stays the same as it scrolls off into history
+
+// viewLine is the line number shown at screen line y
+func (th *termHandler) viewLine(y int) int {
+	return th.historyBase + len(th.history) - th.scrollOffset + y
+}
+
+// line returns the numbered line, nil if it is no longer kept
+func (th *termHandler) line(n int) []Cell {
+	idx := n - th.historyBase
+	if idx < 0 || idx >= len(th.history)+len(th.buffer) {
+		return nil
+	}
+	if idx < len(th.history) {
+		return th.history[idx]
+	}
+	return th.buffer[idx-len(th.history)]
+}
+
+// touch records a change to screen row y
+func (mw *termHandler) touch(y int) {
+	mw.edits++
+	mw.lineEdits[mw.historyBase+len(mw.history)+y] = mw.edits
+}
+
+// touchAll records a change to every screen row
+func (mw *termHandler) touchAll() {
+	for y := range mw.buffer {
+		mw.touch(y)
+	}
+}
+
+// lineVersion changes whenever the numbered line does
+func (th *termHandler) lineVersion(n int) int {
+	return th.lineEdits[n]
+}
+
+// Scroll moves the view into the scrollback by lines, negative goes back down
+func (mw *termHandler) Scroll(lines int) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	mw.scroll(lines)
+}
+
+// ScrollPage scrolls by half a screen a page, negative goes back down
+func (mw *termHandler) ScrollPage(pages int) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	mw.scroll(pages * len(mw.buffer) / 2)
+}
+
+// ScrollToTop shows the oldest line kept
+func (mw *termHandler) ScrollToTop() {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	mw.scroll(len(mw.history))
+}
 
+// ScrollToBottom goes back to the live screen
+func (mw *termHandler) ScrollToBottom() {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	mw.scroll(-len(mw.history))
+}
+
+// scroll is Scroll for callers already holding mu
+func (mw *termHandler) scroll(lines int) {
+	mw.scrollOffset += lines
+	if mw.scrollOffset > len(mw.history) {
+		mw.scrollOffset = len(mw.history)
+	}
+	if mw.scrollOffset < 0 {
+		mw.scrollOffset = 0
+	}
+}
+
+// screenText is the text currently in view, one line per row, callers
+// hold mu
+func (th *termHandler) screenText() string {
+	lines := make([]string, len(th.buffer))
+	for y := range th.buffer {
+		lines[y] = rowText(th.viewRow(y))
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
+
+func rowText(row []Cell) string {
+	s := ""
+	for _, cell := range row {
+		if cell.char == "" || cell.char == "\x00" {
+			s += " "
+		} else {
+			s += cell.char
+		}
+	}
+	return strings.TrimRight(s, " ")
 }
 
 func (mw *termHandler) WriteChar(x, y int, ch string) {
 	mw.buffer[y][x].char = ch
+	mw.buffer[y][x].style = mw.pen
+	mw.touch(y)
 }
 func (mw *termHandler) SetCursor(x, y int) {
 	mw.cursorX = x
@@ -124,129 +625,200 @@ func (mw *termHandler) eraseBuffer() {
 	}
 }
 func (mw *termHandler) eraseLine(y int) {
+	mw.eraseCells(y, 0, len(mw.buffer[0]))
+}
+
+// eraseCells blanks the columns from up to but not including to of row y
+func (mw *termHandler) eraseCells(y, from, to int) {
 	if y < 0 || y >= len(mw.buffer) {
 		return
 	}
-	for x := range mw.buffer[y] {
-		mw.buffer[y][x].style.background = mw.defBG
-		mw.buffer[y][x].style.foreground = mw.defFG
+	if from < 0 {
+		from = 0
+	}
+	if to > len(mw.buffer[y]) {
+		to = len(mw.buffer[y])
+	}
+	mw.touch(y)
+	for x := from; x < to; x++ {
+		mw.buffer[y][x].style = TermColor{foreground: mw.defFG, background: mw.defBG}
 		mw.buffer[y][x].char = ""
 	}
 }
 
+// eraseAfterCursor blanks from the cursor to the end of the screen
 func (mw *termHandler) eraseAfterCursor() {
-	for y := mw.cursorY; y < len(mw.buffer); y++ {
-		startx := 0
-		if y == mw.cursorY {
-			startx = mw.cursorX
-		}
-		for x := startx; x < len(mw.buffer[0]); x++ {
-			mw.buffer[y][x].style.background = mw.defBG
-			mw.buffer[y][x].style.foreground = mw.defFG
-			mw.buffer[y][x].char = ""
-		}
+	mw.eraseCells(mw.cursorY, mw.cursorX, len(mw.buffer[0]))
+	for y := mw.cursorY + 1; y < len(mw.buffer); y++ {
+		mw.eraseLine(y)
+	}
+}
+
+// eraseBeforeCursor blanks from the start of the screen through the cursor
+func (mw *termHandler) eraseBeforeCursor() {
+	for y := 0; y < mw.cursorY; y++ {
+		mw.eraseLine(y)
 	}
+	mw.eraseCells(mw.cursorY, 0, mw.cursorX+1)
 }
 
 func (mw *termHandler) HandleEscape(code string) {
 	code = code[1:]
 
-	if code == "[?2004h" || code == "[?2004l" {
-		//ignore
+	if code == "[?2004h" {
+		mw.bracketedPaste = true
 		return
 	}
-	//UP
-	if code == "[A" {
-		mw.cursorY--
-		mw.safeCursor()
+	if code == "[?2004l" {
+		mw.bracketedPaste = false
 		return
 	}
-	if code[:1] == "[" && code[len(code)-1:] == "A" {
-		deltay := 0
-		n, err := fmt.Sscanf(code, "[%dA", &deltay)
-		if n != 1 || err != nil {
-			safePrintAns(code)
-			log.Fatal(err)
-		}
-		mw.cursorY -= deltay
+	//cursor movement, a missing or zero count moves by one
+	if body, ok := csiBody(code, "A"); ok {
+		mw.cursorY -= csiCount(body)
 		mw.safeCursor()
 		return
 	}
-	//DOWN
-	if code == "[B" {
-		mw.cursorY++
+	if body, ok := csiBody(code, "B"); ok {
+		mw.cursorY += csiCount(body)
 		mw.safeCursor()
 		return
 	}
-	if code[:1] == "[" && code[len(code)-1:] == "B" {
-		deltay := 0
-		n, err := fmt.Sscanf(code, "[%dB", &deltay)
-		if n != 1 || err != nil {
-			safePrintAns(code)
-			log.Fatal(err)
-		}
-		mw.cursorY += deltay
+	if body, ok := csiBody(code, "C"); ok {
+		mw.cursorX += csiCount(body)
 		mw.safeCursor()
 		return
 	}
-	//RIGHT
-	if code == "[C" {
-		mw.cursorX++
+	if body, ok := csiBody(code, "D"); ok {
+		mw.cursorX -= csiCount(body)
 		mw.safeCursor()
 		return
 	}
-	if code[:1] == "[" && code[len(code)-1:] == "C" {
-		deltax := 0
-		n, err := fmt.Sscanf(code, "[%dC", &deltax)
-		if n != 1 || err != nil {
-			safePrintAns(code)
-			log.Fatal(err)
-		}
-		mw.cursorX += deltax
+	if body, ok := csiBody(code, "G"); ok {
+		mw.cursorX = csiCount(body) - 1
 		mw.safeCursor()
 		return
 	}
-	//LEFT
-	if code == "[D" {
-		mw.cursorX--
-		mw.safeCursor()
-		return
+	//CUP is row;column counting from 1
+	body, ok := csiBody(code, "H")
+	if !ok {
+		body, ok = csiBody(code, "f")
 	}
-	if code[:1] == "[" && code[len(code)-1:] == "D" {
-		deltay := 0
-		n, err := fmt.Sscanf(code, "[%dD", &deltay)
-		if n != 1 || err != nil {
-			safePrintAns(code)
-			log.Fatal(err)
+	if ok {
+		params := csiParams(body, 1)
+		row, col := params[0], 1
+		if len(params) > 1 {
+			col = params[1]
 		}
-		mw.cursorX -= deltay
+		mw.SetCursor(col-1, row-1)
 		mw.safeCursor()
 		return
 	}
 
-	if code == "[J" || code == "[0J" {
-		mw.eraseAfterCursor()
+	if body, ok := csiBody(code, "J"); ok {
+		switch csiParams(body, 0)[0] {
+		case 0:
+			mw.eraseAfterCursor()
+			return
+		case 1:
+			mw.eraseBeforeCursor()
+			return
+		case 2:
+			mw.eraseBuffer()
+			return
+		case 3:
+			mw.clearHistory()
+			return
+		}
+	}
+	if body, ok := csiBody(code, "K"); ok {
+		switch csiParams(body, 0)[0] {
+		case 0:
+			mw.eraseCells(mw.cursorY, mw.cursorX, len(mw.buffer[0]))
+			return
+		case 1:
+			mw.eraseCells(mw.cursorY, 0, mw.cursorX+1)
+			return
+		case 2:
+			mw.eraseLine(mw.cursorY)
+			return
+		}
+	}
+	if body, ok := csiBody(code, "m"); ok {
+		mw.handleSGR(body)
 		return
 	}
-	if code == "[2J" || code == "[3J" {
-		mw.eraseBuffer()
+	if len(code) > 2 && code[:1] == "[" && code[len(code)-1:] == "u" && strings.ContainsAny(code[1:2], "<=>?") {
+		mw.handleKittyKeyboard(code)
 		return
 	}
-	if code == "[H" {
-		mw.SetCursor(0, 0)
+	if strings.HasSuffix(code, " q") && code[:1] == "[" {
+		//DECSCUSR
+		style := csiParams(code[1:len(code)-2], 0)[0]
+		if style > 6 {
+			style = 0
+		}
+		mw.cursorStyle = style
 		return
 	}
-	if code[len(code)-1:] == "H" && code[:1] == "[" {
-		y := 0
-		x := 0
-		n, err := fmt.Sscanf(code, "[%d;%d", &x, &y)
-		if n != 2 || err != nil {
-			log.Println("Not read")
-			log.Fatal(err)
+	if code == "[?2026h" {
+		mw.beginSync()
+		return
+	}
+	if code == "[?2026l" {
+		mw.endSync()
+		return
+	}
+	if strings.HasSuffix(code, "$p") && code[:1] == "[" {
+		//DECRQM
+		if code[1:2] == "?" {
+			mode := csiParams(code[2:len(code)-2], 0)[0]
+			mw.reply(fmt.Sprintf("\x1b[?%d;%d$y", mode, mw.modeState(mode)))
+		} else {
+			mode := csiParams(code[1:len(code)-2], 0)[0]
+			mw.reply(fmt.Sprintf("\x1b[%d;0$y", mode))
 		}
-		mw.cursorX = x
-		mw.cursorY = y
-		mw.safeCursor()
+		return
+	}
+	if code == "[?1h" {
+		mw.appCursorKeys = true
+		return
+	}
+	if code == "[?1l" {
+		mw.appCursorKeys = false
+		return
+	}
+	if code == "[?5h" || code == "[?5l" {
+		mw.reverseVideo = code == "[?5h"
+		mw.touchAll()
+		return
+	}
+	if code == "c" {
+		mw.reset()
+		return
+	}
+	if code == "[!p" {
+		mw.softReset()
+		return
+	}
+	if code == "#8" {
+		mw.alignmentPattern()
+		return
+	}
+	if code == "[?8h" {
+		mw.autoRepeat = true
+		return
+	}
+	if code == "[?8l" {
+		mw.autoRepeat = false
+		return
+	}
+	if code == "=" {
+		mw.appKeypad = true
+		return
+	}
+	if code == ">" {
+		mw.appKeypad = false
 		return
 	}
 	if code == "[?25h" {
@@ -259,39 +831,155 @@ func (mw *termHandler) HandleEscape(code string) {
 	}
 	if code == "[?1049h" {
 		//use alternate
-		mw.useAlternate = true
+		if !mw.useAlternate {
+			mw.savedX, mw.savedY = mw.cursorX, mw.cursorY
+			mw.buffer, mw.alternate = mw.alternate, mw.buffer
+			mw.useAlternate = true
+			mw.eraseBuffer()
+			mw.touchAll()
+		}
 		return
 	}
 	if code == "[?1049l" {
 		//use default
-		mw.useAlternate = false
+		if mw.useAlternate {
+			mw.buffer, mw.alternate = mw.alternate, mw.buffer
+			mw.useAlternate = false
+			mw.cursorX, mw.cursorY = mw.savedX, mw.savedY
+			mw.touchAll()
+		}
 		return
 	}
 
-	if code == "[K" || code == "[0K" {
-		mw.eraseAfterCursor()
-		return
+	mw.unknownEscape(code)
+}
+
+// softReset is DECSTR, modes go back to their defaults but the screen is kept
+func (mw *termHandler) softReset() {
+	mw.cursorEnabled = true
+	mw.cursorStyle = 0
+	mw.appCursorKeys = false
+	mw.appKeypad = false
+	mw.autoRepeat = true
+	mw.pen = TermColor{}
+	mw.savedX, mw.savedY = 0, 0
+	if mw.syncActive {
+		mw.endSync()
 	}
-	if code == "[2K" {
-		mw.eraseLine(mw.cursorY)
-		return
+}
+
+// reset is RIS, the terminal goes back to how NewTerminal made it apart
+// from the scrollback
+func (mw *termHandler) reset() {
+	mw.softReset()
+	if mw.useAlternate {
+		mw.buffer, mw.alternate = mw.alternate, mw.buffer
+		mw.useAlternate = false
 	}
+	for y := range mw.alternate {
+		mw.alternate[y] = make([]Cell, len(mw.alternate[y]))
+	}
+	mw.eraseBuffer()
+	mw.SetCursor(0, 0)
+	mw.scrollOffset = 0
+	mw.reverseVideo = false
+	mw.bracketedPaste = false
+	mw.kittyFlags = [2][]int{}
+}
 
-	if code[:1] == "[" && code[len(code)-1:] == "G" {
-		x := 0
-		n, err := fmt.Sscanf(code, "[%dG", &x)
-		if n != 1 || err != nil {
-			log.Println("Not read")
-			safePrintAns(code)
-			log.Fatal(err)
+// alignmentPattern is DECALN, the screen fills with E's for lining up the display
+func (mw *termHandler) alignmentPattern() {
+	for y := range mw.buffer {
+		for x := range mw.buffer[y] {
+			mw.buffer[y][x].char = "E"
 		}
-		mw.cursorX = x
-		mw.safeCursor()
-		return
 	}
+	mw.touchAll()
+	mw.SetCursor(0, 0)
+}
+
+// Parameters are clamped to this, as xterm does
+const csiParamMax = 65535
+
+// csiParams splits the semicolon separated parameters of a control
+// sequence, missing or unreadable parameters are given def
+func csiParams(body string, def int) []int {
+	fields := strings.Split(body, ";")
+	params := make([]int, len(fields))
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if errors.Is(err, strconv.ErrRange) || n > csiParamMax {
+			n = csiParamMax
+		} else if err != nil || n < 0 {
+			n = def
+		}
+		params[i] = n
+	}
+	return params
+}
 
-	safePrintAns(code)
+// csiBody is the parameters of a CSI sequence ending in final, ok is false
+// for any other sequence, including ones with a private marker
+func csiBody(code, final string) (body string, ok bool) {
+	if len(code) < 1+len(final) || code[0] != '[' || !strings.HasSuffix(code, final) {
+		return "", false
+	}
+	body = code[1 : len(code)-len(final)]
+	if strings.Trim(body, "0123456789;:") != "" {
+		return "", false
+	}
+	return body, true
+}
+
+// csiCount is the first parameter as a repeat count, 0 counts as 1
+func csiCount(body string) int {
+	n := csiParams(body, 1)[0]
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+// unknownEscape counts a sequence that isn't handled, each kind is logged
+// the first time it shows up
+func (mw *termHandler) unknownEscape(code string) {
+	kind := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' || r == ';' {
+			return -1
+		}
+		return r
+	}, code)
+	if len(kind) > 4 {
+		//string sequences like OSC are told apart by their start
+		kind = kind[:4]
+	}
+	mw.unknownEscapes[kind]++
+	if mw.unknownEscapes[kind] == 1 {
+		safePrintAns("unhandled ESC" + code)
+	}
+}
+
+// reply queues a response to a query for the program, the pty isn't
+// written with mu held as a full pty would stall drawing too
+func (mw *termHandler) reply(s string) {
+	mw.replies = append(mw.replies, s)
+}
+
+// sendReplies writes the queued replies to the program, it takes mu
+// itself so it's called after Write has released it
+func (mw *termHandler) sendReplies() {
+	mw.mu.Lock()
+	replies := mw.replies
+	mw.replies = nil
+	mw.mu.Unlock()
+	if term_pty == nil {
+		return
+	}
+	for _, s := range replies {
+		term_pty.WriteString(s)
+	}
 }
+
 func (mw *termHandler) safeCursor() {
 	if mw.cursorX < 0 {
 		mw.cursorX = 0
@@ -300,18 +988,119 @@ func (mw *termHandler) safeCursor() {
 		mw.cursorY = 0
 	}
 
-	if mw.cursorX > len(mw.buffer[0]) {
+	if mw.cursorX >= len(mw.buffer[0]) {
 		mw.cursorX = len(mw.buffer[0]) - 1
 	}
-	if mw.cursorY > len(mw.buffer) {
+	if mw.cursorY >= len(mw.buffer) {
 		mw.cursorY = len(mw.buffer) - 1
 	}
 }
+
+// dropHistory forgets the oldest n lines of history, line numbers carry on
+// from where they were
+func (mw *termHandler) dropHistory(n int) {
+	mw.historyBase += n
+	mw.history = mw.history[n:]
+	if mw.scrollOffset > len(mw.history) {
+		mw.scrollOffset = len(mw.history)
+	}
+	for line := range mw.lineEdits {
+		if line < mw.historyBase {
+			delete(mw.lineEdits, line)
+		}
+	}
+}
+
+// clearHistory is ED 3, which clear sends to empty the scrollback
+func (mw *termHandler) clearHistory() {
+	mw.dropHistory(len(mw.history))
+}
+
 func (mw *termHandler) ScrollDown() {
+	if !mw.useAlternate {
+		mw.history = append(mw.history, mw.buffer[0])
+		if mw.scrollOffset > 0 {
+			//keep the view still while output continues
+			mw.scrollOffset++
+		}
+		if len(mw.history) > scrollbackLines {
+			mw.dropHistory(len(mw.history) - scrollbackLines)
+		}
+	}
 	mw.buffer = append(mw.buffer[1:], make([]Cell, len(mw.buffer[0])))
+	if mw.useAlternate {
+		//without history the line numbers stay put while the text moves
+		mw.touchAll()
+	}
+}
+
+// Longest escape sequence held back for the rest of it to arrive, OSC
+// strings such as window titles are the long ones
+const maxHeldEscape = 4096
+
+// splitIncomplete cuts what a read ended in the middle of, an escape
+// sequence or a UTF-8 character, off the end of s so it can be put in front
+// of the next read
+func splitIncomplete(s string) (complete, rest string) {
+	from := len(s) - maxHeldEscape
+	if from < 0 {
+		from = 0
+	}
+	for i := from; i < len(s); i++ {
+		if s[i] == 0x1b && escapePrefix(s[i:]) {
+			return s[:i], s[i:]
+		}
+	}
+	for i := len(s) - 1; i >= 0 && i >= len(s)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(s[i]) {
+			if !utf8.FullRuneInString(s[i:]) {
+				return s[:i], s[i:]
+			}
+			break
+		}
+	}
+	return s, ""
+}
+
+// escapePrefix is true when more bytes could still make s, starting with
+// ESC, into a sequence
+func escapePrefix(s string) bool {
+	if len(s) == 1 {
+		return true
+	}
+	inRange := func(t string, lo, hi byte) bool {
+		for i := 0; i < len(t); i++ {
+			if t[i] < lo || t[i] > hi {
+				return false
+			}
+		}
+		return true
+	}
+	switch {
+	case s[1] == '[':
+		//parameters and intermediates, the final byte hasn't come
+		return inRange(s[2:], 0x20, 0x3f)
+	case strings.IndexByte("]P_^X", s[1]) >= 0:
+		//a string until BEL or ESC \, the ESC may be the last byte
+		body := s[2:]
+		if strings.HasSuffix(body, "\x1b") {
+			body = body[:len(body)-1]
+		}
+		return !strings.ContainsAny(body, "\x07\x1b")
+	}
+	return inRange(s[1:], 0x20, 0x2f)
 }
+
 func (mw *termHandler) Write(bs []byte) (int, error) {
-	line := string(bs)
+	defer mw.sendReplies()
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	mw.blinkStart = time.Now()
+	mw.lastWrite = mw.blinkStart
+	mw.watchOutput(string(bs))
+
+	line, held := splitIncomplete(mw.held + string(bs))
+	mw.held = held
 	ansiIndices := FindAnsiIndex(line)
 	var ansiIndex = 0
 	for i := 0; i < len(line); i++ {
@@ -323,14 +1112,9 @@ func (mw *termHandler) Write(bs []byte) (int, error) {
 				code := line[i:endAnsi]
 				mw.HandleEscape(code)
 
-				//safePrintAns("Line: " + line)
-				//log.Println(ansiIndices)
-				i = endAnsi
+				//the loop moves on to the byte after the sequence
+				i = endAnsi - 1
 				ansiIndex++
-				if ansiIndex < len(ansiIndices) && i == ansiIndices[ansiIndex][0] {
-					i -= 1
-					//handle that next iteration
-				}
 				continue
 			}
 		}
@@ -353,6 +1137,7 @@ func (mw *termHandler) Write(bs []byte) (int, error) {
 			mw.safeCursor()
 			continue
 		} else if char == 0x07 {
+			mw.ring()
 
 			continue
 		} else if char == 0x08 {
@@ -364,14 +1149,15 @@ func (mw *termHandler) Write(bs []byte) (int, error) {
 		}
 
 		//knownset := " \"'!@#$%^&*(){}[]/\\|"
+		//multi byte characters take up one cell
+		r, size := utf8.DecodeRuneInString(line[i:])
+		i += size - 1
 		//bounds check buffer access
 		if mw.cursorY < len(mw.buffer) {
 			if mw.cursorX < len(mw.buffer[0]) { //no line wrapping yet
-				if mw.useAlternate {
-					mw.alternate[mw.cursorY][mw.cursorX].char = string(line[i])
-				} else {
-					mw.buffer[mw.cursorY][mw.cursorX].char = string(line[i])
-				}
+				mw.buffer[mw.cursorY][mw.cursorX].char = string(r)
+				mw.buffer[mw.cursorY][mw.cursorX].style = mw.pen
+				mw.touch(mw.cursorY)
 				mw.cursorX++
 
 			}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"image"
+	"io"
+	"log"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestCsiParams(t *testing.T) {
+	tests := []struct {
+		body string
+		def  int
+		want []int
+	}{
+		{"", 1, []int{1}},
+		{"5", 1, []int{5}},
+		{";5", 1, []int{1, 5}},
+		{"3;", 0, []int{3, 0}},
+		{"99999", 0, []int{csiParamMax}},
+		{"99999999999999999999999", 0, []int{csiParamMax}},
+		{"-4;x", 7, []int{7, 7}},
+	}
+	for _, tt := range tests {
+		if got := csiParams(tt.body, tt.def); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("csiParams(%q, %d) = %v, want %v", tt.body, tt.def, got, tt.want)
+		}
+	}
+}
+
+func TestCsiBody(t *testing.T) {
+	tests := []struct {
+		code, final string
+		body        string
+		ok          bool
+	}{
+		{"[;5H", "H", ";5", true},
+		{"[H", "H", "", true},
+		{"[38:2::1:2:3m", "m", "38:2::1:2:3", true},
+		{"[?25h", "h", "", false},
+		{"[5J", "K", "", false},
+		{"[", "H", "", false},
+		{"", "H", "", false},
+	}
+	for _, tt := range tests {
+		body, ok := csiBody(tt.code, tt.final)
+		if body != tt.body || ok != tt.ok {
+			t.Errorf("csiBody(%q, %q) = %q, %v, want %q, %v", tt.code, tt.final, body, ok, tt.body, tt.ok)
+		}
+	}
+}
+
+func testTerminal() *termHandler {
+	log.SetOutput(io.Discard)
+	return NewTerminal(10, 4, 7, 13)
+}
+
+func TestWriteCursor(t *testing.T) {
+	tests := []struct {
+		input    string
+		row, col int
+	}{
+		{"\x1b[;5H", 0, 4},
+		{"\x1b[3;H", 2, 0},
+		{"\x1b[2;3f", 1, 2},
+		{"\x1b[99999999999999999999;99999999999H", 3, 9},
+		{"\x1b[0;0H", 0, 0},
+		{"\x1b[4G", 0, 3},
+	}
+	for _, tt := range tests {
+		th := testTerminal()
+		th.Write([]byte(tt.input))
+		if th.cursorY != tt.row || th.cursorX != tt.col {
+			t.Errorf("%q put the cursor at %d,%d, want %d,%d", tt.input, th.cursorY, th.cursorX, tt.row, tt.col)
+		}
+	}
+}
+
+func TestErase(t *testing.T) {
+	full := "aaaaaaaaaa\r\nbbbbbbbbbb\r\ncccccccccc\r\ndddddddddd"
+	tests := []struct {
+		erase string
+		want  []string
+	}{
+		{"\x1b[K", []string{"aaaaaaaaaa", "bbbb", "cccccccccc", "dddddddddd"}},
+		{"\x1b[0K", []string{"aaaaaaaaaa", "bbbb", "cccccccccc", "dddddddddd"}},
+		{"\x1b[1K", []string{"aaaaaaaaaa", "     bbbbb", "cccccccccc", "dddddddddd"}},
+		{"\x1b[2K", []string{"aaaaaaaaaa", "", "cccccccccc", "dddddddddd"}},
+		{"\x1b[J", []string{"aaaaaaaaaa", "bbbb", "", ""}},
+		{"\x1b[1J", []string{"", "     bbbbb", "cccccccccc", "dddddddddd"}},
+		{"\x1b[2J", []string{"", "", "", ""}},
+	}
+	for _, tt := range tests {
+		th := testTerminal()
+		th.Write([]byte(full + "\x1b[2;5H" + tt.erase))
+		for y, want := range tt.want {
+			if got := rowText(th.buffer[y]); got != want {
+				t.Errorf("%q left row %d as %q, want %q", tt.erase, y, got, want)
+			}
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	tests := []struct {
+		input string
+		paste bool
+	}{
+		{"\x1b[?2004h", true},
+		{"\x1b[?2004h\x1b[!p", true},
+		{"\x1b[?2004h\x1bc", false},
+	}
+	for _, tt := range tests {
+		th := testTerminal()
+		th.Write([]byte(tt.input))
+		if th.bracketedPaste != tt.paste {
+			t.Errorf("%q left bracketed paste %v, want %v", tt.input, th.bracketedPaste, tt.paste)
+		}
+	}
+}
+
+func TestReverseVideoBorder(t *testing.T) {
+	th := testTerminal()
+	img := image.NewRGBA(image.Rect(0, 0, 10*7+2*int(term_borders_dims[0]), 4*13+2*int(term_borders_dims[1])))
+	corners := []image.Point{{0, 0}, {img.Rect.Dx() - 1, img.Rect.Dy() - 1}}
+	for _, input := range []string{"", "\x1b[?5h", "\x1b[?5l"} {
+		th.Write([]byte(input))
+		th.DrawToImage(img)
+		for _, p := range corners {
+			if got := img.RGBAAt(p.X, p.Y); got != th.gapColor() {
+				t.Errorf("after %q the border at %v is %v, want %v", input, p, got, th.gapColor())
+			}
+		}
+	}
+}
+
+func TestSplitWrite(t *testing.T) {
+	tests := []struct {
+		chunks []string
+		want   string
+		pen    TermColor
+	}{
+		{[]string{"\xe2", "\x94\x80x"}, "─x", TermColor{}},
+		{[]string{"\xe2\x94", "\x80"}, "─", TermColor{}},
+		{[]string{"\x1b[3", "1mX"}, "X", TermColor{foreground: paletteColor(1)}},
+		{[]string{"\x1b", "[31mX"}, "X", TermColor{foreground: paletteColor(1)}},
+		{[]string{"a\x1b]0;ti", "tle\x07b"}, "ab", TermColor{}},
+		{[]string{"a\x1b]0;title\x1b", "\\b"}, "ab", TermColor{}},
+		{[]string{"\x1b[\x01", "x"}, "\x01x", TermColor{}},
+	}
+	for _, tt := range tests {
+		th := testTerminal()
+		for _, chunk := range tt.chunks {
+			th.Write([]byte(chunk))
+		}
+		if got := rowText(th.buffer[0]); got != tt.want {
+			t.Errorf("%q drew %q, want %q", tt.chunks, got, tt.want)
+		}
+		if th.buffer[0][0].style != tt.pen {
+			t.Errorf("%q wrote with %+v, want %+v", tt.chunks, th.buffer[0][0].style, tt.pen)
+		}
+	}
+}
+
+func TestScrollback(t *testing.T) {
+	th := testTerminal()
+	for i := 0; i < scrollbackLines+10; i++ {
+		th.Write([]byte("line\r\n"))
+	}
+	th.Write([]byte("\x1b[1;1HA"))
+	th.Scroll(5)
+	top := th.viewLine(0)
+	th.Write([]byte("\r\n\r\n\r\n\r\nB\r\n"))
+	if th.viewLine(0) != top || rowText(th.viewRow(0)) != "line" {
+		t.Errorf("the view moved from line %d to %d with full history", top, th.viewLine(0))
+	}
+
+	th.Write([]byte("\x1b[H\x1b[2J\x1b[3J"))
+	if len(th.history) != 0 || th.scrollOffset != 0 {
+		t.Errorf("CSI 3J left %d lines of history and offset %d", len(th.history), th.scrollOffset)
+	}
+	for line := range th.lineEdits {
+		if line < th.historyBase {
+			t.Errorf("CSI 3J kept edits of line %d", line)
+		}
+	}
+}
+
+// checkWrite writes input and fails if the terminal crashes or the cursor
+// ends up off the screen
+func checkWrite(t *testing.T, input []byte) {
+	th := testTerminal()
+	th.Write(input)
+	if th.cursorY < 0 || th.cursorY >= len(th.buffer) || th.cursorX < 0 || th.cursorX > len(th.buffer[0]) {
+		t.Fatalf("%q left the cursor at %d,%d", input, th.cursorY, th.cursorX)
+	}
+}
+
+func TestWriteRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	//mostly escapes and parameter bytes so sequences get parsed
+	alphabet := []byte("\x1b[;?0123456789:HJKmhlfGABCDrsu \r\n\t\x07\x08\xffa")
+	for i := 0; i < 2000; i++ {
+		input := make([]byte, r.Intn(64))
+		for j := range input {
+			if r.Intn(4) == 0 {
+				input[j] = byte(r.Intn(256))
+			} else {
+				input[j] = alphabet[r.Intn(len(alphabet))]
+			}
+		}
+		checkWrite(t, input)
+	}
+}
+
+func FuzzWrite(f *testing.F) {
+	for _, seed := range []string{
+		"\x1b[;5H",
+		"\x1b[99999999999999999999;1H",
+		"\x1b[38;2;300;-1;9999m",
+		"\x1b[38:5m\x1b[48;5m",
+		"\x1b[?5h\x1b#8\x1bc",
+		"\x1b[1K\x1b[1J\x1b[K",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(checkWrite)
+}
+
+func TestReplies(t *testing.T) {
+	tests := []struct {
+		codes []string
+		want  []string
+	}{
+		{[]string{"\x1b[?u"}, []string{"\x1b[?0u"}},
+		{[]string{"\x1b[>9u", "\x1b[?u"}, []string{"\x1b[?9u"}},
+		{[]string{"\x1b[?2004h", "\x1b[?2004$p"}, []string{"\x1b[?2004;1$y"}},
+		{[]string{"\x1b[?2004$p", "\x1b[4$p"}, []string{"\x1b[?2004;2$y", "\x1b[4;0$y"}},
+		{[]string{"\x1b[?2004h"}, nil},
+	}
+	for _, tt := range tests {
+		th := testTerminal()
+		for _, code := range tt.codes {
+			th.HandleEscape(code)
+		}
+		if !reflect.DeepEqual(th.replies, tt.want) {
+			t.Errorf("%q queued %q, want %q", tt.codes, th.replies, tt.want)
+		}
+		th.Write([]byte("\x1b[?u"))
+		if len(th.replies) != 0 {
+			t.Errorf("Write left %q queued", th.replies)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/go-gl/glfw/v3.3/glfw"
 )
@@ -15,55 +14,267 @@ var (
 	bloomStrength     float32 = 1.2
 	bloomBrightness   float32 = 1.4
 )
+
+// Shape of the glass, curvature is per axis with positive values bulging
+// out like a CRT and negative ones pinching in
+var (
+	curvatureX   float32 = 0
+	curvatureY   float32 = 0
+	cornerRadius float32 = .06
+	overscan     float32 = 0 //part of the image hidden past the edges
+)
+
+// Phosphor mask over the glass, the pitch is in pixels a trio at the
+// default window size
+const (
+	maskNone = iota
+	maskShadow
+	maskApertureGrille
+	maskSlot
+)
+
+var maskNames = []string{"None", "Shadow Mask", "Aperture Grille", "Slot Mask"}
+
+var (
+	maskType             = maskNone
+	maskStrength float32 = .3
+	maskPitch    float32 = 3
+)
+
+// Analog signal faults, all off by default. Convergence and jitter are in
+// pixels of the terminal image, ghost offset too
+var (
+	convergence   float32 = 0
+	syncJitter    float32 = 0
+	flicker       float32 = 0
+	flickerRate           = flicker60
+	ghosting      float32 = 0
+	ghostOffset   float32 = 6
+	interlace     float32 = 0
+	signalSeconds float32 //time the signal has been running, wraps so it stays precise
+	signalField   int     //interlaced field being drawn, 0 or 1
+)
+
+const (
+	flicker50 = iota
+	flicker60
+)
+
+var flickerRateNames = []string{"50 Hz", "60 Hz"}
+var flickerHz = []float32{50, 60}
+
+// Phosphor afterglow, off by default. Decay is the part of the glow each
+// channel keeps from one frame to the next at 60fps
+var (
+	persistence float32 = 0
+	decayRed    float32 = .6
+	decayGreen  float32 = .75
+	decayBlue   float32 = .5
+)
+
+// Bloom is blurred over a chain of levels, each half the size of the last
+var (
+	bloomRadius         = 6 //taps each side of a pixel
+	bloomSigma  float32 = 3
+	bloomLevels         = 3
+)
+
+// Cursor defaults for programs that don't set one, DECSCUSR 0 goes back to these
+var (
+	cursorShape             = cursorBlock
+	cursorBlink             = true
+	cursorBlinkRate float32 = .53 //seconds the cursor stays on or off
+)
+
 var showui = false
 var selected int = 1
-var selections = map[int]*float32{
-	0: &text_brightness,
-	1: &scanline_strength,
-	2: &noiseStrength,
-	3: &ambient,
-	4: &bloomStrength,
-	5: &bloomBrightness,
+var selections = []setting{
+	choiceSetting{"Phosphor", &phosphor, phosphorNames},
+	floatSetting{"Text Brightness", &text_brightness, .01, 0, 2},
+	floatSetting{"Scanline Strength", &scanline_strength, .01, 0, 1},
+	floatSetting{"Noise Strength", &noiseStrength, .01, 0, 1},
+	floatSetting{"Ambient Light", &ambient, .01, 0, 1},
+	floatSetting{"Curvature X", &curvatureX, .01, -.5, .5},
+	floatSetting{"Curvature Y", &curvatureY, .01, -.5, .5},
+	floatSetting{"Corner Radius", &cornerRadius, .01, 0, .5},
+	floatSetting{"Overscan", &overscan, .005, 0, .5},
+	choiceSetting{"Mask", &maskType, maskNames},
+	floatSetting{"Mask Strength", &maskStrength, .01, 0, 1},
+	floatSetting{"Mask Pitch", &maskPitch, .5, 1, 12},
+	floatSetting{"Convergence", &convergence, .25, -4, 4},
+	floatSetting{"Sync Jitter", &syncJitter, .25, 0, 8},
+	floatSetting{"Flicker", &flicker, .01, 0, 1},
+	choiceSetting{"Flicker Rate", &flickerRate, flickerRateNames},
+	floatSetting{"Ghosting", &ghosting, .01, 0, 1},
+	floatSetting{"Ghost Offset", &ghostOffset, 1, -32, 32},
+	floatSetting{"Interlace", &interlace, .01, 0, 1},
+	floatSetting{"Bloom Strength", &bloomStrength, .01, 0, 4},
+	floatSetting{"Bloom Brightness", &bloomBrightness, .01, 0, 4},
+	intSetting{"Bloom Radius", &bloomRadius, 1, 32},
+	floatSetting{"Bloom Sigma", &bloomSigma, .1, .1, 16},
+	intSetting{"Bloom Levels", &bloomLevels, 1, maxBloomLevels},
+	floatSetting{"Persistence", &persistence, .01, 0, 1},
+	floatSetting{"Decay Red", &decayRed, .01, 0, 1},
+	floatSetting{"Decay Green", &decayGreen, .01, 0, 1},
+	floatSetting{"Decay Blue", &decayBlue, .01, 0, 1},
+	fontSetting{},
+	floatSetting{"Font Size", &fontSize, 1, minFontSize, maxFontSize},
+	boolSetting{"GPU Text", &gpuText},
+	choiceSetting{"Cursor Shape", &cursorShape, cursorShapeNames},
+	boolSetting{"Cursor Blink", &cursorBlink},
+	floatSetting{"Cursor Blink Rate", &cursorBlinkRate, .05, 0, 2},
+	boolSetting{"Alt Is Meta", &altIsMeta},
+	boolSetting{"Alt Sends Escape", &metaSendsEscape},
+	choiceSetting{"Bell", &bellMode, bellModeNames},
+}
+
+// A line of the settings menu, changed with left and right
+type setting interface {
+	label() string
+	increment()
+	decrement()
+}
+
+// floatSetting steps a value by step between min and max
+type floatSetting struct {
+	name     string
+	value    *float32
+	step     float32
+	min, max float32
+}
+
+func (s floatSetting) label() string { return fmt.Sprintf("%s: <%2.3f>", s.name, *s.value) }
+func (s floatSetting) increment() {
+	*s.value += s.step
+	if *s.value > s.max {
+		*s.value = s.max
+	}
+}
+func (s floatSetting) decrement() {
+	*s.value -= s.step
+	if *s.value < s.min {
+		*s.value = s.min
+	}
+}
+
+// intSetting steps a whole number between min and max
+type intSetting struct {
+	name     string
+	value    *int
+	min, max int
+}
+
+func (s intSetting) label() string { return fmt.Sprintf("%s: <%d>", s.name, *s.value) }
+func (s intSetting) increment() {
+	if *s.value < s.max {
+		*s.value++
+	}
+}
+func (s intSetting) decrement() {
+	if *s.value > s.min {
+		*s.value--
+	}
+}
+
+// choiceSetting picks one of a list of names
+type choiceSetting struct {
+	name    string
+	value   *int
+	choices []string
 }
 
+func (s choiceSetting) label() string { return fmt.Sprintf("%s: <%s>", s.name, s.choices[*s.value]) }
+func (s choiceSetting) increment()    { *s.value = (*s.value + 1) % len(s.choices) }
+func (s choiceSetting) decrement() {
+	*s.value = (*s.value + len(s.choices) - 1) % len(s.choices)
+}
+
+type boolSetting struct {
+	name  string
+	value *bool
+}
+
+func (s boolSetting) label() string {
+	if *s.value {
+		return s.name + ": <On>"
+	}
+	return s.name + ": <Off>"
+}
+func (s boolSetting) increment() { *s.value = !*s.value }
+func (s boolSetting) decrement() { *s.value = !*s.value }
+
 func keyCall(w *glfw.Window, key glfw.Key, scancode int, action glfw.Action, mods glfw.ModifierKey) {
-	if key == glfw.KeyS && action == glfw.Press && mods == glfw.ModControl {
-		showui = !showui
-		fmt.Println("switch", showui)
+	lockMods := mods & (glfw.ModCapsLock | glfw.ModNumLock)
+	mods &^= lockMods
+	if action == glfw.Press {
+		suppressChar = false
 	}
-	if key == glfw.KeyQ && mods == glfw.ModControl && action == glfw.Press {
-		os.Exit(0)
+
+	if action != glfw.Release && runKeybinding(w, key, action, mods) {
+		suppressChar = true
+		return
 	}
 
-	if key == glfw.KeyF11 && action == glfw.Press {
-		if w.GetMonitor() == nil {
-			w.SetMonitor(glfw.GetPrimaryMonitor(), 0, 0, glfw.GetPrimaryMonitor().GetVideoMode().Width, glfw.GetPrimaryMonitor().GetVideoMode().Height, 60)
-		} else {
-			w.SetMonitor(nil, 0, 0, int(win_dims[0]), int(win_dims[1]), 60)
-		}
+	if search.open && !showui {
+		searchKey(key, action, mods)
+		return
 	}
 
 	if showui {
-		if key == glfw.KeyUp && action == glfw.Release {
+		if action == glfw.Release {
+			return
+		}
+		if key == glfw.KeyUp {
 			prevSelection()
 		}
-		if key == glfw.KeyDown && action == glfw.Release {
+		if key == glfw.KeyDown {
 			nextSelection()
 		}
-		if key == glfw.KeyLeft && action == glfw.Release {
+		if key == glfw.KeyLeft {
 			lowerSelection()
 		}
-		if key == glfw.KeyRight && action == glfw.Release {
+		if key == glfw.KeyRight {
 			incrementSelection()
 		}
 	} else {
-		if key == glfw.KeyBackspace && action == glfw.Press {
-			term_pty.Write([]byte{0x08})
+		modes := term_handler.keyModes()
+		if action == glfw.Repeat && !modes.autoRepeat {
+			//DECARM is off, drop the repeat and the text it would type
+			suppressChar = true
+			return
+		}
+		if modes.flags != 0 {
+			if str, ok := kittyKeySequence(key, scancode, action, mods|lockMods, modes.flags); ok {
+				sendToPty(str)
+				return
+			}
+		}
+		if action == glfw.Release {
+			return
+		}
+		if str, ok := keySequence(key, mods|lockMods, modes); ok {
+			sendToPty(str)
+			return
+		}
+
+		alt := mods&glfw.ModAlt != 0
+		if mods&glfw.ModControl != 0 {
+			if code, ok := controlCode(key, scancode); ok {
+				if alt {
+					sendToPty(metaEncode(string([]byte{code})))
+				} else {
+					sendToPty(string([]byte{code}))
+				}
+			}
+			return
 		}
 
 		for keycomb, str := range keymap {
-			if key == keycomb.key && mods == keycomb.mod && action == glfw.Press {
-				term_pty.WriteString(str)
+			if key == keycomb.key && mods&^glfw.ModAlt == keycomb.mod {
+				if alt {
+					str = metaEncode(str)
+				}
+				sendToPty(str)
 			}
 		}
 	}
@@ -75,147 +286,55 @@ type keyCombo struct {
 	mod glfw.ModifierKey
 }
 
+// keymap holds the special and modified keys, printable text arrives
+// through charCall so that it follows the active keyboard layout
 var keymap = map[keyCombo]string{
-	{glfw.KeyLeft, 0}:  "\x1b[1D",
-	{glfw.KeyRight, 0}: "\x1b[1C",
-	{glfw.KeyUp, 0}:    "\x1b[1A",
-	{glfw.KeyDown, 0}:  "\x1b[1B",
-
-	{glfw.KeyEnter, 0}:             "\r",
-	{glfw.KeyTab, 0}:               "\t",
-	{glfw.KeySpace, 0}:             " ",
-	{glfw.KeyMinus, 0}:             "-",
-	{glfw.KeyMinus, glfw.ModShift}: "_",
-
-	{glfw.KeyEqual, 0}:             "=",
-	{glfw.KeyEqual, glfw.ModShift}: "+",
-
-	{glfw.KeyComma, 0}:              ",",
-	{glfw.KeyPeriod, 0}:             ".",
-	{glfw.KeyComma, glfw.ModShift}:  "<",
-	{glfw.KeyPeriod, glfw.ModShift}: ">",
-
-	{glfw.KeyGraveAccent, 0}:             "`",
-	{glfw.KeyGraveAccent, glfw.ModShift}: "~",
-
-	{glfw.KeySlash, 0}:             "/",
-	{glfw.KeySlash, glfw.ModShift}: "?",
-
-	{glfw.KeyApostrophe, 0}:             "'",
-	{glfw.KeyApostrophe, glfw.ModShift}: "\"",
-
-	{glfw.KeyBackslash, 0}:             "\\",
-	{glfw.KeyBackslash, glfw.ModShift}: "|",
-
-	{glfw.KeyLeftBracket, 0}:             "[",
-	{glfw.KeyLeftBracket, glfw.ModShift}: "{",
-
-	{glfw.KeyRightBracket, 0}:             "]",
-	{glfw.KeyRightBracket, glfw.ModShift}: "}",
-
-	{glfw.KeySemicolon, 0}:             ";",
-	{glfw.KeySemicolon, glfw.ModShift}: ":",
-
-	{glfw.KeyC, glfw.ModControl}: string([]byte{0x03}),
-	{glfw.KeyD, glfw.ModControl}: string([]byte{0x04}),
-	{glfw.KeyZ, glfw.ModControl}: string([]byte{0x04}),
-
-	{glfw.KeySlash, 0}: "/",
-
-	{glfw.Key0, 0}: "0",
-	{glfw.Key1, 0}: "1",
-	{glfw.Key2, 0}: "2",
-	{glfw.Key3, 0}: "3",
-	{glfw.Key4, 0}: "4",
-	{glfw.Key5, 0}: "5",
-	{glfw.Key6, 0}: "6",
-	{glfw.Key7, 0}: "7",
-	{glfw.Key8, 0}: "8",
-	{glfw.Key9, 0}: "9",
-
-	{glfw.Key0, glfw.ModShift}: ")",
-	{glfw.Key1, glfw.ModShift}: "!",
-	{glfw.Key2, glfw.ModShift}: "@",
-	{glfw.Key3, glfw.ModShift}: "#",
-	{glfw.Key4, glfw.ModShift}: "$",
-	{glfw.Key5, glfw.ModShift}: "%",
-	{glfw.Key6, glfw.ModShift}: "^",
-	{glfw.Key7, glfw.ModShift}: "&",
-	{glfw.Key8, glfw.ModShift}: "*",
-	{glfw.Key9, glfw.ModShift}: "(",
-
-	{glfw.KeyA, 0}: "a",
-	{glfw.KeyB, 0}: "b",
-	{glfw.KeyC, 0}: "c",
-	{glfw.KeyD, 0}: "d",
-	{glfw.KeyE, 0}: "e",
-	{glfw.KeyF, 0}: "f",
-	{glfw.KeyG, 0}: "g",
-	{glfw.KeyH, 0}: "h",
-	{glfw.KeyI, 0}: "i",
-	{glfw.KeyJ, 0}: "j",
-	{glfw.KeyK, 0}: "k",
-	{glfw.KeyL, 0}: "l",
-	{glfw.KeyM, 0}: "m",
-	{glfw.KeyN, 0}: "n",
-	{glfw.KeyO, 0}: "o",
-	{glfw.KeyP, 0}: "p",
-	{glfw.KeyQ, 0}: "q",
-	{glfw.KeyR, 0}: "r",
-	{glfw.KeyS, 0}: "s",
-	{glfw.KeyT, 0}: "t",
-	{glfw.KeyU, 0}: "u",
-	{glfw.KeyV, 0}: "v",
-	{glfw.KeyW, 0}: "w",
-	{glfw.KeyX, 0}: "x",
-	{glfw.KeyY, 0}: "y",
-	{glfw.KeyZ, 0}: "z",
-
-	{glfw.KeyA, glfw.ModShift}: "A",
-	{glfw.KeyB, glfw.ModShift}: "B",
-	{glfw.KeyC, glfw.ModShift}: "C",
-	{glfw.KeyD, glfw.ModShift}: "D",
-	{glfw.KeyE, glfw.ModShift}: "E",
-	{glfw.KeyF, glfw.ModShift}: "F",
-	{glfw.KeyG, glfw.ModShift}: "G",
-	{glfw.KeyH, glfw.ModShift}: "H",
-	{glfw.KeyI, glfw.ModShift}: "I",
-	{glfw.KeyJ, glfw.ModShift}: "J",
-	{glfw.KeyK, glfw.ModShift}: "K",
-	{glfw.KeyL, glfw.ModShift}: "L",
-	{glfw.KeyM, glfw.ModShift}: "M",
-	{glfw.KeyN, glfw.ModShift}: "N",
-	{glfw.KeyO, glfw.ModShift}: "O",
-	{glfw.KeyP, glfw.ModShift}: "P",
-	{glfw.KeyQ, glfw.ModShift}: "Q",
-	{glfw.KeyR, glfw.ModShift}: "R",
-	{glfw.KeyS, glfw.ModShift}: "S",
-	{glfw.KeyT, glfw.ModShift}: "T",
-	{glfw.KeyU, glfw.ModShift}: "U",
-	{glfw.KeyV, glfw.ModShift}: "V",
-	{glfw.KeyW, glfw.ModShift}: "W",
-	{glfw.KeyX, glfw.ModShift}: "X",
-	{glfw.KeyY, glfw.ModShift}: "Y",
-	{glfw.KeyZ, glfw.ModShift}: "Z",
+	{glfw.KeyEnter, 0}:           "\r",
+	{glfw.KeyTab, 0}:             "\t",
+	{glfw.KeyTab, glfw.ModShift}: "\x1b[Z",
+	{glfw.KeyEscape, 0}:          "\x1b",
+	{glfw.KeyBackspace, 0}:       "\x08",
 }
 
-func incrementSelection() {
-	sel := selections[selected]
-	if sel == nil {
+// charCall receives text input after the keyboard layout, dead keys and
+// input methods have been applied and sends it to the pty as UTF-8
+func charCall(w *glfw.Window, char rune, mods glfw.ModifierKey) {
+	if showui {
 		return
 	}
-	*sel += float32(.01)
-}
-func lowerSelection() {
-	sel := selections[selected]
-	if sel == nil {
+	if mods&glfw.ModControl != 0 {
+		//Handled by keyCall
+		return
+	}
+	if suppressChar {
+		suppressChar = false
+		return
+	}
+	if search.open {
+		//typed into the prompt whatever the program asked keys to send
+		search.addChar(char)
 		return
 	}
-	*sel -= float32(.01)
+	if flags := term_handler.keyModes().flags; flags&kittyAllKeys != 0 || (flags != 0 && mods&(glfw.ModAlt|glfw.ModSuper) != 0) {
+		//Sent as CSI u by keyCall
+		return
+	}
+	if mods&glfw.ModAlt != 0 && altIsMeta {
+		sendToPty(metaEncode(string(char)))
+		return
+	}
+	sendToPty(string(char))
+}
+
+func incrementSelection() {
+	selections[selected].increment()
+}
+func lowerSelection() {
+	selections[selected].decrement()
 }
 
 func nextSelection() {
-	if selected < 5 {
+	if selected < len(selections)-1 {
 		selected++
 	}
 }
@@ -227,19 +346,41 @@ func prevSelection() {
 func MakeUI() []string {
 	lines := []string{}
 	lines = append(lines, "[Settings]:")
-	lines = append(lines, fmt.Sprintf("Text Brightness: <%2.3f>", text_brightness))
-	lines = append(lines, fmt.Sprintf("Scanline Strength: <%2.3f>", scanline_strength))
-	lines = append(lines, fmt.Sprintf("Noise Strength: <%2.3f>", noiseStrength))
-	lines = append(lines, fmt.Sprintf("Ambient Light: <%2.3f>", ambient))
-	lines = append(lines, fmt.Sprintf("Bloom Strength: <%2.3f>", bloomStrength))
-	lines = append(lines, fmt.Sprintf("Bloom Brightness: <%2.3f>", bloomBrightness))
+	for _, sel := range selections {
+		lines = append(lines, sel.label())
+	}
 	lines = append(lines, "")
 	lines = append(lines, "[Guide]:")
-	lines = append(lines, "F11: Toggle Fullscreen")
-	lines = append(lines, "Ctrl + Q: Quit")
-	lines = append(lines, "Ctrl + S: Toggle Settings")
+	for _, guide := range []struct{ action, text string }{
+		{"fullscreen", "Toggle Fullscreen"},
+		{"quit", "Quit"},
+		{"settings", "Toggle Settings"},
+		{"copy", "Copy"},
+		{"paste", "Paste"},
+		{"search", "Search"},
+		{"scroll_page_up", "Scroll Up"},
+		{"scroll_page_down", "Scroll Down"},
+		{"zoom_in", "Zoom In"},
+		{"zoom_out", "Zoom Out"},
+	} {
+		if combo, ok := bindingFor(guide.action); ok {
+			lines = append(lines, combo+": "+guide.text)
+		}
+	}
 	lines[selected+1] = "> " + lines[min(selected+1, len(lines)-1)]
 
+	//keep the selected line in view when the menu is taller than the screen
+	rows := int(term_cells[1])
+	if len(lines) > rows {
+		top := selected + 1 - rows/2
+		if top < 0 {
+			top = 0
+		}
+		if top > len(lines)-rows {
+			top = len(lines) - rows
+		}
+		lines = lines[top : top+rows]
+	}
 	return lines
 }
 